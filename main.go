@@ -3,22 +3,172 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"container/heap"
+	"container/list"
 	"encoding/binary"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
-	"unsafe"
+	"syscall"
+	"time"
 )
 
-const ID_SIZE = 4
-const USER_NAME_SIZE = 32
-const EMAIL_SIZE = 255
-const ID_OFFSET = 0
-const USER_NAME_OFFSET = ID_OFFSET + ID_SIZE
-const EMAIL_OFFSET = USER_NAME_OFFSET + USER_NAME_SIZE
-const ROW_SIZE = ID_SIZE + USER_NAME_SIZE + EMAIL_SIZE
-const PAGE_SIZE = 4096
-const TABLE_MAX_PAGES = 100
+/*
+ * Key Layout
+ * A key is a list of components, each a type tag followed by the value.
+ * int64 values take 8 bytes, text and blob values are prefixed
+ * with their length as a uvarint.
+ */
+const KEY_TAG_SIZE = 1
+const KEY_INT64_SIZE = 8
+const MAX_KEY_SIZE = 64 // Encoded size, small enough for four leaf cells and the internal node cells of the smallest page
+const DEFAULT_KEY_TYPE = "int64"
+const DEFAULT_PAGE_SIZE = 4096
+const MIN_PAGE_SIZE = 512
+const MAX_PAGE_SIZE = 65536
+const DEFAULT_CACHE_SIZE = 100 // Number of pages kept in memory between operations
+const DEFAULT_JOURNAL_MODE = "delete"
+const DEFAULT_SYNCHRONOUS = "full"
+const DEFAULT_BUSY_TIMEOUT = 0         // Milliseconds to wait for a lock held by another process
+const WAL_AUTOCHECKPOINT_FRAMES = 1000 // A commit leaving more frames in the log checkpoints it
+const DEFAULT_FILL_FACTOR = 90         // Percentage of each leaf filled by the bulk loader
+const MIN_FILL_FACTOR = 50
+const MAX_FILL_FACTOR = 100
+const LOAD_SORT_RUN_SIZE = 10000 // Rows sorted in memory at a time when the load file is not sorted
+
+/*
+ * Database Header Layout
+ * Page 0 holds the database header, the tree starts at the root page
+ */
+const HEADER_PAGE_NUM = 0
+const ROOT_PAGE_NUM = 1 // Root page of a new database
+const FORMAT_VERSION = 1
+const HEADER_MAGIC = "GoSQLite format\x00"
+const HEADER_MAGIC_SIZE = 16
+const HEADER_MAGIC_OFFSET = 0
+const HEADER_FORMAT_VERSION_SIZE = 4
+const HEADER_FORMAT_VERSION_OFFSET = HEADER_MAGIC_OFFSET + HEADER_MAGIC_SIZE
+const HEADER_PAGE_SIZE_SIZE = 4
+const HEADER_PAGE_SIZE_OFFSET = HEADER_FORMAT_VERSION_OFFSET + HEADER_FORMAT_VERSION_SIZE
+const HEADER_ROOT_PAGE_SIZE = 4
+const HEADER_ROOT_PAGE_OFFSET = HEADER_PAGE_SIZE_OFFSET + HEADER_PAGE_SIZE_SIZE
+const FREELIST_TRUNK_PAGE_SIZE = 4 // First trunk page of the free list, 0 if empty
+const FREELIST_TRUNK_PAGE_OFFSET = HEADER_ROOT_PAGE_OFFSET + HEADER_ROOT_PAGE_SIZE
+const FREELIST_PAGE_COUNT_SIZE = 4 // Number of pages on the free list, trunks included
+const FREELIST_PAGE_COUNT_OFFSET = FREELIST_TRUNK_PAGE_OFFSET + FREELIST_TRUNK_PAGE_SIZE
+const HEADER_PAGE_COUNT_SIZE = 4 // Number of pages in the file as of the last close
+const HEADER_PAGE_COUNT_OFFSET = FREELIST_PAGE_COUNT_OFFSET + FREELIST_PAGE_COUNT_SIZE
+const HEADER_SCHEMA_COOKIE_SIZE = 4 // Bumped on every schema change
+const HEADER_SCHEMA_COOKIE_OFFSET = HEADER_PAGE_COUNT_OFFSET + HEADER_PAGE_COUNT_SIZE
+const HEADER_KEY_TYPES_SIZE = 8 // Type of each key component, KEY_TYPE_NONE after the last one
+const HEADER_KEY_TYPES_OFFSET = HEADER_SCHEMA_COOKIE_OFFSET + HEADER_SCHEMA_COOKIE_SIZE
+const HEADER_CHANGE_COUNTER_SIZE = 4 // Bumped on every commit, so other processes know their cache is stale
+const HEADER_CHANGE_COUNTER_OFFSET = HEADER_KEY_TYPES_OFFSET + HEADER_KEY_TYPES_SIZE
+const HEADER_SIZE = HEADER_CHANGE_COUNTER_OFFSET + HEADER_CHANGE_COUNTER_SIZE
+
+/*
+ * Free List Trunk Page Layout
+ * Each trunk page points to the next trunk and lists free leaf pages
+ */
+const FREELIST_NEXT_TRUNK_SIZE = 4
+const FREELIST_NEXT_TRUNK_OFFSET = 0
+const FREELIST_NUM_LEAVES_SIZE = 4
+const FREELIST_NUM_LEAVES_OFFSET = FREELIST_NEXT_TRUNK_OFFSET + FREELIST_NEXT_TRUNK_SIZE
+const FREELIST_TRUNK_HEADER_SIZE = FREELIST_NEXT_TRUNK_SIZE + FREELIST_NUM_LEAVES_SIZE
+const FREELIST_LEAF_SIZE = 4
+
+/*
+ * Rollback Journal Layout
+ * Before a page of the database file is first modified, its original
+ * image is appended to the journal. A journal left behind by a crash is
+ * hot: playing it back restores the file to the last committed state.
+ */
+const JOURNAL_SUFFIX = "-journal"
+const JOURNAL_MAGIC = "GoSQLite journal"
+const JOURNAL_MAGIC_SIZE = 16
+const JOURNAL_MAGIC_OFFSET = 0
+const JOURNAL_PAGE_SIZE_SIZE = 4
+const JOURNAL_PAGE_SIZE_OFFSET = JOURNAL_MAGIC_OFFSET + JOURNAL_MAGIC_SIZE
+const JOURNAL_PAGE_COUNT_SIZE = 4 // Pages in the database file when the journal was started
+const JOURNAL_PAGE_COUNT_OFFSET = JOURNAL_PAGE_SIZE_OFFSET + JOURNAL_PAGE_SIZE_SIZE
+const JOURNAL_HEADER_SIZE = JOURNAL_PAGE_COUNT_OFFSET + JOURNAL_PAGE_COUNT_SIZE
+const JOURNAL_RECORD_PAGE_NUM_SIZE = 4 // Each record is a page num followed by the page image
+
+/*
+ * Write-Ahead Log Layout
+ * In WAL mode modified pages are appended to the log as frames instead of
+ * being written to the database file. A frame with a page count ends a
+ * commit; a checkpoint copies the newest committed frames into the file
+ * and starts the log over with the next checkpoint sequence number, which
+ * tells other processes that the frames they indexed are gone.
+ */
+const WAL_SUFFIX = "-wal"
+const WAL_MAGIC = "GoSQLite WAL\x00\x00\x00\x00"
+const WAL_MAGIC_SIZE = 16
+const WAL_MAGIC_OFFSET = 0
+const WAL_PAGE_SIZE_SIZE = 4
+const WAL_PAGE_SIZE_OFFSET = WAL_MAGIC_OFFSET + WAL_MAGIC_SIZE
+const WAL_CHECKPOINT_SEQ_SIZE = 4
+const WAL_CHECKPOINT_SEQ_OFFSET = WAL_PAGE_SIZE_OFFSET + WAL_PAGE_SIZE_SIZE
+const WAL_HEADER_SIZE = WAL_CHECKPOINT_SEQ_OFFSET + WAL_CHECKPOINT_SEQ_SIZE
+const WAL_FRAME_PAGE_NUM_SIZE = 4
+const WAL_FRAME_PAGE_NUM_OFFSET = 0
+const WAL_FRAME_COMMIT_SIZE = 4 // Database size in pages after the commit, 0 if the frame does not end a commit
+const WAL_FRAME_COMMIT_OFFSET = WAL_FRAME_PAGE_NUM_OFFSET + WAL_FRAME_PAGE_NUM_SIZE
+const WAL_FRAME_CHECKSUM_SIZE = 4 // CRC32C of the rest of the frame header and the page image
+const WAL_FRAME_CHECKSUM_OFFSET = WAL_FRAME_COMMIT_OFFSET + WAL_FRAME_COMMIT_SIZE
+const WAL_FRAME_HEADER_SIZE = WAL_FRAME_CHECKSUM_OFFSET + WAL_FRAME_CHECKSUM_SIZE
+
+/*
+ * Lock Layout
+ * Processes coordinate through advisory locks on bytes past any real page,
+ * as SQLite does: a shared lock is a read lock on the shared range, the
+ * reserved lock a write lock on its byte, and an exclusive lock a write
+ * lock on the pending byte and the whole shared range. A writer waiting
+ * for the exclusive lock holds the pending byte so no new readers start.
+ * Every process also holds a read lock on the byte of its journal mode
+ * while the database is open, so the modes are never mixed and the last
+ * process using the WAL can tell it is the last.
+ */
+const LOCK_PENDING_BYTE = 0x40000000
+const LOCK_RESERVED_BYTE = LOCK_PENDING_BYTE + 1
+const LOCK_SHARED_FIRST = LOCK_PENDING_BYTE + 2
+const LOCK_SHARED_SIZE = 510
+const LOCK_WAL_BYTE = LOCK_SHARED_FIRST + LOCK_SHARED_SIZE
+const LOCK_ROLLBACK_BYTE = LOCK_WAL_BYTE + 1
+const LOCK_RETRY_INTERVAL = 10 * time.Millisecond
+
+/*
+ * Page Trailer Layout
+ * Every page ends with a CRC32C checksum of the rest of the page
+ */
+const PAGE_CHECKSUM_SIZE = 4
+const PAGE_TRAILER_SIZE = PAGE_CHECKSUM_SIZE
+
+var CHECKSUM_TABLE = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+ * Page Size Dependent Layout
+ * Set by configure_page_layout once the page size of the database is known
+ */
+var PAGE_SIZE uint32
+var PAGE_USABLE_SIZE uint32 // Bytes of a page before the trailer
+var FREELIST_TRUNK_MAX_LEAVES uint32
+var LEAF_NODE_SPACE_FOR_CELLS uint32
+var LEAF_NODE_MAX_LOCAL_PAYLOAD uint32 // Payload bytes kept in the cell, the rest goes to overflow pages
+var LEAF_NODE_MIN_USED_SPACE uint32    // Non-root leaves using fewer bytes are rebalanced
+var OVERFLOW_PAGE_DATA_SIZE uint32
+var INTERNAL_NODE_MAX_CELLS uint32
+var INTERNAL_NODE_MIN_CELLS uint32 // Non-root internal nodes below this are rebalanced
 
 /*
  * Common Node Header Layout
@@ -39,20 +189,53 @@ const LEAF_NODE_NUM_CELLS_SIZE = 4
 const LEAF_NODE_NUM_CELLS_OFFSET = COMMON_NODE_HEADER_SIZE
 const LEAF_NODE_NEXT_LEAF_SIZE = 4
 const LEAF_NODE_NEXT_LEAF_OFFSET = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NUM_CELLS_SIZE
-const LEAF_NODE_HEADER_SIZE = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_SIZE
+const LEAF_NODE_CELL_CONTENT_START_SIZE = 4 // Start of the cell content area, which grows down from the page end
+const LEAF_NODE_CELL_CONTENT_START_OFFSET = LEAF_NODE_NEXT_LEAF_OFFSET + LEAF_NODE_NEXT_LEAF_SIZE
+const LEAF_NODE_FIRST_FREEBLOCK_SIZE = 2 // Offset of the first free block in the content area, 0 if none
+const LEAF_NODE_FIRST_FREEBLOCK_OFFSET = LEAF_NODE_CELL_CONTENT_START_OFFSET + LEAF_NODE_CELL_CONTENT_START_SIZE
+const LEAF_NODE_FRAGMENTED_BYTES_SIZE = 2 // Bytes in the content area too small to be a free block
+const LEAF_NODE_FRAGMENTED_BYTES_OFFSET = LEAF_NODE_FIRST_FREEBLOCK_OFFSET + LEAF_NODE_FIRST_FREEBLOCK_SIZE
+const LEAF_NODE_HEADER_SIZE = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_SIZE +
+	LEAF_NODE_CELL_CONTENT_START_SIZE + LEAF_NODE_FIRST_FREEBLOCK_SIZE + LEAF_NODE_FRAGMENTED_BYTES_SIZE
 
 /*
  * Leaf Node Body Layout
+ * An array of cell offsets in key order follows the header,
+ * the cells themselves are stored at the end of the page
+ */
+const LEAF_NODE_CELL_POINTER_SIZE = 2
+
+/*
+ * Free Block Layout
+ * Space freed inside the content area is kept in a chain of
+ * free blocks sorted by offset, so it can be reused by new cells
+ */
+const FREEBLOCK_NEXT_SIZE = 2 // 0 on the last free block
+const FREEBLOCK_NEXT_OFFSET = 0
+const FREEBLOCK_SIZE_SIZE = 2
+const FREEBLOCK_SIZE_OFFSET = FREEBLOCK_NEXT_OFFSET + FREEBLOCK_NEXT_SIZE
+const FREEBLOCK_MIN_SIZE = FREEBLOCK_NEXT_SIZE + FREEBLOCK_SIZE_SIZE
+
+/*
+ * Leaf Node Cell Layout
+ * The header is followed by the key and the payload, which is the
+ * serialized row. When the payload is larger than
+ * LEAF_NODE_MAX_LOCAL_PAYLOAD the rest is stored in a chain of
+ * overflow pages and the cell ends with the first page num of the chain.
+ */
+const LEAF_NODE_KEY_SIZE_SIZE = 2
+const LEAF_NODE_KEY_SIZE_OFFSET = 0
+const LEAF_NODE_PAYLOAD_SIZE_SIZE = 4
+const LEAF_NODE_PAYLOAD_SIZE_OFFSET = LEAF_NODE_KEY_SIZE_OFFSET + LEAF_NODE_KEY_SIZE_SIZE
+const LEAF_NODE_CELL_HEADER_SIZE = LEAF_NODE_KEY_SIZE_SIZE + LEAF_NODE_PAYLOAD_SIZE_SIZE
+const LEAF_NODE_OVERFLOW_PAGE_SIZE = 4
+
+/*
+ * Overflow Page Layout
  */
-const LEAF_NODE_KEY_SIZE = 4
-const LEAF_NODE_KEY_OFFSET = 0
-const LEAF_NODE_VALUE_SIZE = ROW_SIZE
-const LEAF_NODE_VALUE_OFFSET = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
-const LEAF_NODE_CELL_SIZE = LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
-const LEAF_NODE_SPACE_FOR_CELLS = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
-const LEAF_NODE_MAX_CELLS = LEAF_NODE_SPACE_FOR_CELLS / LEAF_NODE_CELL_SIZE
-const LEAF_NODE_RIGHT_SPLIT_COUNT = (LEAF_NODE_MAX_CELLS + 1) / 2
-const LEAF_NODE_LEFT_SPLIT_COUNT = LEAF_NODE_MAX_CELLS + 1 - LEAF_NODE_RIGHT_SPLIT_COUNT
+const OVERFLOW_NEXT_PAGE_SIZE = 4 // 0 on the last page of a chain
+const OVERFLOW_NEXT_PAGE_OFFSET = 0
+const OVERFLOW_HEADER_SIZE = OVERFLOW_NEXT_PAGE_SIZE
 
 /*
  * Internal Node Header Layout
@@ -66,45 +249,204 @@ const INTERNAL_NODE_HEADER_SIZE = COMMON_NODE_HEADER_SIZE + INTERNAL_NODE_NUM_KE
 /*
  * Internal Node Body Layout
  */
-const INTENRAL_NODE_KEY_SIZE = 4   // Store key id
 const INTENRAL_NODE_CHILD_SIZE = 4 // Store child page number
-const INTERNAL_NODE_CELL_SIZE = INTENRAL_NODE_KEY_SIZE + INTENRAL_NODE_CHILD_SIZE
-const INTERNAL_NODE_MAX_CELLS = 3
+const INTERNAL_NODE_KEY_SIZE_SIZE = 2
+const INTENRAL_NODE_KEY_SIZE = INTERNAL_NODE_KEY_SIZE_SIZE + MAX_KEY_SIZE // Store key size and key, padded to the max key size
+const INTERNAL_NODE_CELL_SIZE = INTENRAL_NODE_CHILD_SIZE + INTENRAL_NODE_KEY_SIZE
 
 type MetaCommandResult int32
 type PrepareStatementResult int32
 type StatementType int32
 type ExecuteResult int32
 type NodeType uint8
+type KeyType uint8
+type Column int32
+type JournalMode int32
+type LockLevel int32
+type Synchronous int32
+
+/*
+ * Return a negative number, 0 or a positive number
+ * when key a sorts before, equal to or after key b
+ */
+type KeyComparator func(a []byte, b []byte) int
+
+/*
+ * Return the next row to load, or nil after the last one
+ */
+type RowIterator func() *Row
 
 type Statement struct {
 	statementType StatementType
 	rowToInsert   *Row
+	keyToDelete   []byte
+	assignments   []Assignment
+	predicate     *Predicate // rows to update, nil for every row
+	keyRange      KeyRange   // rows to select
+	descending    bool
+	limit         int64 // -1 for no limit
+	savepointName string
+}
+
+/*
+ * Range of keys of a scan, a nil bound leaves that side open
+ */
+type KeyRange struct {
+	lower          []byte
+	lowerInclusive bool
+	upper          []byte
+	upperInclusive bool
+}
+
+/*
+ * column = value in the set clause of an update
+ */
+type Assignment struct {
+	column Column
+	value  string
+	key    []byte // encoded value when the column is the key
+}
+
+/*
+ * column = value in the where clause of an update
+ */
+type Predicate struct {
+	column Column
+	value  string
+	key    []byte // encoded value when the column is the key
 }
 
 type Row struct {
-	id       uint32
+	key      []byte
 	username string
 	email    string
 }
 
+type Options struct {
+	cacheSize   uint32
+	pageSize    uint32    // Only used when creating a new database
+	keyTypes    []KeyType // Only used when creating a new database
+	journalMode JournalMode
+	busyTimeout uint32 // milliseconds
+	synchronous Synchronous
+}
+
+/*
+ * Images of the pages as they were when a savepoint was started. A page is
+ * only saved in the newest savepoint, so rolling back to an older one also
+ * restores the images saved in every savepoint after it.
+ */
+type Savepoint struct {
+	name     string
+	numPages uint32
+	pages    map[uint32][]byte
+}
+
+type CachedPage struct {
+	pageNum  uint32
+	data     []byte
+	dirty    bool          // modified since it was last written to the file
+	pinCount uint32        // pinned pages are never evicted
+	element  *list.Element // position in the LRU list
+}
+
 type Pager struct {
-	fileDescriptor *os.File
-	fileLength     uint32
-	numPages       uint32
-	pages          [][]byte
+	fileName        string
+	fileDescriptor  *os.File
+	fileLength      int64
+	numPages        uint32
+	pages           map[uint32]*CachedPage
+	lru             *list.List // most recently used page at the front
+	cacheSize       uint32
+	journalFile     *os.File         // open once a page was modified since the last commit
+	journalSynced   bool             // every record of the journal is on disk
+	journaledPages  map[uint32]bool  // pages whose original image is in the journal
+	journalNumPages uint32           // pages in the database file when the journal was started
+	modified        bool             // pages were modified since the last commit
+	journalMode     JournalMode      // mode whose lock byte is held while the database is open
+	walFile         *os.File         // open in WAL mode, nil otherwise
+	walIndex        map[uint32]int64 // offset of the newest committed frame of each page
+	walPending      map[uint32]int64 // offset of the frames written since the last commit
+	walNumFrames    uint32           // frames in the log, committed or not
+	walNumPages     uint32           // database size recorded by the last commit frame
+	walCheckpoints  uint32           // checkpoint sequence number of the log when it was indexed
+	savepoints      []*Savepoint     // savepoints of the transaction, newest last
+	lock            LockLevel        // lock held on the database file
+	busyTimeout     time.Duration    // how long to wait for a lock held by another process
+	changeCounter   uint32           // change counter of the file when the cache was last valid
+	synchronous     Synchronous      // which writes are waited for until they are on disk
+	stats           PagerStats
+}
+
+/*
+ * Page I/O of a pager since the database was opened
+ */
+type PagerStats struct {
+	cacheHits     uint64 // pages found in the cache
+	pageReads     uint64 // pages read from the database file or the log
+	pageWrites    uint64 // pages written to the database file
+	journalWrites uint64 // original page images saved in the journal
+	walWrites     uint64 // frames appended to the log
 }
 
 type Table struct {
-	rootPageNum uint32
-	pager       *Pager
+	rootPageNum   uint32
+	pager         *Pager
+	keyTypes      []KeyType
+	compareKeys   KeyComparator
+	inTransaction bool // statements are committed by commit instead of one by one
 }
 
 type Cursor struct {
+	table          *Table
+	pageNum        uint32
+	cellNum        uint32
+	endOfTable     bool   // indicates a position one past the last element
+	upperBound     []byte // the scan ends before keys after it, nil for no bound
+	upperInclusive bool
+	lowerBound     []byte // a reverse scan ends before keys before it, nil for no bound
+	lowerInclusive bool
+}
+
+type BulkLoader struct {
 	table      *Table
-	pageNum    uint32
-	cellNum    uint32
-	endOfTable bool // indicates a position one past the last element
+	fillFactor uint32
+	cells      [][]byte // cells of the leaf being filled
+	usedSpace  uint32   // bytes taken by those cells and their pointers
+	lastKey    []byte
+	leaves     []uint32 // leaves written so far in key order
+	maxKeys    [][]byte // max key of each written leaf
+}
+
+/*
+ * A sorted run of rows in a temporary file, read back during the merge
+ */
+type SortRun struct {
+	file   *os.File
+	reader *bufio.Reader
+	row    *Row // next row of the run, nil when it is exhausted
+}
+
+type SortRunHeap struct {
+	runs        []*SortRun
+	compareKeys KeyComparator
+}
+
+type IntegrityCheck struct {
+	table     *Table
+	pageUsed  []bool   // page belongs to the tree, an overflow chain or the free list
+	corrupt   []bool   // page failed its checksum and is not followed
+	leaves    []uint32 // leaves in key order
+	leafDepth int      // depth of the first leaf found, -1 before that
+	numErrors uint32
+}
+
+/*
+ * Raised by get_page when a page read from disk fails its checksum. The
+ * command that read it is abandoned by abandon_corrupt_command.
+ */
+type PageCorruption struct {
+	pageNum uint32
 }
 
 const (
@@ -114,20 +456,35 @@ const (
 const (
 	PREPARE_STATEMENT_SUCCESS PrepareStatementResult = iota
 	PREPARE_STATEMENT_UNRECOGNIZED
-	PREPARE_STRING_TOO_LONG
 	PREPARE_SYNTAX_ERROR
+	PREPARE_KEY_TOO_LONG
 )
 
 const (
 	STATEMENT_INSERT StatementType = iota
 	STATEMENT_SELECT
+	STATEMENT_DELETE
+	STATEMENT_UPDATE
+	STATEMENT_VACUUM
+	STATEMENT_BEGIN
+	STATEMENT_COMMIT
+	STATEMENT_ROLLBACK
+	STATEMENT_SAVEPOINT
+	STATEMENT_RELEASE
+	STATEMENT_ROLLBACK_TO
 )
 
 const (
 	EXECUTE_SUCCESS ExecuteResult = iota
-	EXECUTE_TABLE_FULL
 	EXECUTE_FAILURE
 	EXECUTE_DUPLICATE_KEY
+	EXECUTE_KEY_NOT_FOUND
+	EXECUTE_KEY_OUT_OF_ORDER
+	EXECUTE_TABLE_NOT_EMPTY
+	EXECUTE_TRANSACTION_ACTIVE
+	EXECUTE_NO_TRANSACTION
+	EXECUTE_NO_SUCH_SAVEPOINT
+	EXECUTE_DATABASE_LOCKED
 )
 
 const (
@@ -135,62 +492,228 @@ const (
 	NODE_LEAF
 )
 
+const (
+	COLUMN_ID Column = iota
+	COLUMN_USERNAME
+	COLUMN_EMAIL
+)
+
+var COLUMN_NAMES = map[string]Column{
+	"id":       COLUMN_ID,
+	"username": COLUMN_USERNAME,
+	"email":    COLUMN_EMAIL,
+}
+
+const (
+	LOCK_NONE      LockLevel = iota
+	LOCK_SHARED              // reading
+	LOCK_RESERVED            // about to write, other processes may still read
+	LOCK_EXCLUSIVE           // writing to the database file
+)
+
+/*
+ * Off never waits for the disk, so a power loss can corrupt the database.
+ * Normal only waits where the database would be corrupted otherwise, so a
+ * power loss can undo the last commits. Full also makes every commit durable.
+ */
+const (
+	SYNCHRONOUS_OFF Synchronous = iota
+	SYNCHRONOUS_NORMAL
+	SYNCHRONOUS_FULL
+)
+
+var SYNCHRONOUS_NAMES = map[string]Synchronous{
+	"off":    SYNCHRONOUS_OFF,
+	"normal": SYNCHRONOUS_NORMAL,
+	"full":   SYNCHRONOUS_FULL,
+}
+
+const (
+	JOURNAL_MODE_DELETE JournalMode = iota
+	JOURNAL_MODE_WAL
+)
+
+var JOURNAL_MODE_NAMES = map[string]JournalMode{
+	"delete": JOURNAL_MODE_DELETE,
+	"wal":    JOURNAL_MODE_WAL,
+}
+
+const (
+	KEY_TYPE_NONE KeyType = iota
+	KEY_TYPE_INT64
+	KEY_TYPE_TEXT
+	KEY_TYPE_BLOB
+)
+
 func main() {
+	options := Options{}
+	cacheSize := flag.Uint("cache-size", DEFAULT_CACHE_SIZE, "number of pages kept in memory")
+	pageSize := flag.Uint("page-size", DEFAULT_PAGE_SIZE, "page size of a new database, a power of two between 512 and 65536")
+	keyType := flag.String("key-type", DEFAULT_KEY_TYPE, "key type of a new database: int64, text, blob, or a comma separated list of them")
+	journalMode := flag.String("journal-mode", DEFAULT_JOURNAL_MODE, "how changes are committed: delete (rollback journal) or wal")
+	busyTimeout := flag.Uint("busy-timeout", DEFAULT_BUSY_TIMEOUT, "milliseconds to wait for a lock held by another process")
+	synchronous := flag.String("synchronous", DEFAULT_SYNCHRONOUS, "when writes are waited for until they are on disk: off, normal or full")
+	flag.Parse()
 
-	if len(os.Args) < 2 {
+	if flag.NArg() < 1 {
 		fmt.Printf("Must supply a database filename.\n")
 		os.Exit(1)
 	}
+	if *cacheSize < 1 {
+		fmt.Printf("Cache size must be at least 1 page.\n")
+		os.Exit(1)
+	}
+	if !is_valid_page_size(*pageSize) {
+		fmt.Printf("Page size must be a power of two between %d and %d.\n", MIN_PAGE_SIZE, MAX_PAGE_SIZE)
+		os.Exit(1)
+	}
+	keyTypes, ok := parse_key_types(*keyType)
+	if !ok {
+		fmt.Printf("Key type must be int64, text, blob, or a comma separated list of at most %d of them.\n", HEADER_KEY_TYPES_SIZE)
+		os.Exit(1)
+	}
+	options.cacheSize = uint32(*cacheSize)
+	options.pageSize = uint32(*pageSize)
+	options.keyTypes = keyTypes
+	options.busyTimeout = uint32(*busyTimeout)
+	if options.journalMode, ok = JOURNAL_MODE_NAMES[*journalMode]; !ok {
+		fmt.Printf("Journal mode must be delete or wal.\n")
+		os.Exit(1)
+	}
+	if options.synchronous, ok = SYNCHRONOUS_NAMES[*synchronous]; !ok {
+		fmt.Printf("Synchronous must be off, normal or full.\n")
+		os.Exit(1)
+	}
 
-	filename := os.Args[1]
-	table := db_open(filename)
+	filename := flag.Arg(0)
+	table := db_open(filename, &options)
 
-	reader := bufio.NewReader(os.Stdin)
+	/*
+	 * Signals are only acted on between statements, so the database
+	 * is never closed while a statement is changing it
+	 */
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	commands := make(chan string)
+	go read_commands(bufio.NewReader(os.Stdin), commands)
 	fmt.Println("Simple SQLite")
 	fmt.Println("---------------------")
 
 	for {
+		pager_trim_cache(table.pager)
 		print_prompt()
-		command, _ := reader.ReadString('\n')
-		// convert CRLF to LF
-		command = strings.Replace(command, "\n", "", -1)
-
-		if command[0] == '.' {
-			switch do_meta_command(command, table) {
-			case (META_COMMAND_SUCCESS):
-				continue
-			case (META_COMMAND_UNRECOGNIZED):
-				fmt.Printf("Unrecognized command '%s'.\n", command)
-				continue
+		var command string
+		select {
+		case line, ok := <-commands:
+			if !ok {
+				db_close(table)
+				os.Exit(0)
 			}
+			command = line
+		case <-signals:
+			db_close(table)
+			os.Exit(0)
 		}
+		run_command(command, table)
+	}
+}
 
-		statement := Statement{}
-		statement.rowToInsert = &Row{}
-		switch prepare_statement(command, &statement) {
-		case (PREPARE_STATEMENT_SUCCESS):
-			break
-		case (PREPARE_SYNTAX_ERROR):
-			fmt.Printf("Syntax error. Could not parse statement.\n")
-			continue
-		case (PREPARE_STRING_TOO_LONG):
-			fmt.Printf("String is too long.\n")
-			continue
-		case (PREPARE_STATEMENT_UNRECOGNIZED):
+/*
+ * Run one line of input: a meta command or a statement
+ */
+func run_command(command string, table *Table) {
+	defer abandon_corrupt_command(table)
+	// convert CRLF to LF
+	command = strings.Replace(command, "\n", "", -1)
+	if command == "" {
+		return
+	}
+
+	if command[0] == '.' {
+		switch do_meta_command(command, table) {
+		case (META_COMMAND_SUCCESS):
+			return
+		case (META_COMMAND_UNRECOGNIZED):
 			fmt.Printf("Unrecognized command '%s'.\n", command)
-			continue
+			return
 		}
+	}
 
-		switch execute_statement(&statement, table) {
-		case (EXECUTE_SUCCESS):
-			fmt.Println("Executed.")
-			break
-		case (EXECUTE_DUPLICATE_KEY):
-			fmt.Printf("Error: Duplicate key.\n")
-			break
-		case (EXECUTE_TABLE_FULL):
-			fmt.Println("Error: Table full.")
-			break
+	statement := Statement{}
+	statement.rowToInsert = &Row{}
+	switch prepare_statement(command, &statement, table) {
+	case (PREPARE_STATEMENT_SUCCESS):
+		break
+	case (PREPARE_SYNTAX_ERROR):
+		fmt.Printf("Syntax error. Could not parse statement.\n")
+		return
+	case (PREPARE_KEY_TOO_LONG):
+		fmt.Printf("Key is too long.\n")
+		return
+	case (PREPARE_STATEMENT_UNRECOGNIZED):
+		fmt.Printf("Unrecognized command '%s'.\n", command)
+		return
+	}
+
+	switch execute_statement(&statement, table) {
+	case (EXECUTE_SUCCESS):
+		fmt.Println("Executed.")
+		break
+	case (EXECUTE_DUPLICATE_KEY):
+		fmt.Printf("Error: Duplicate key.\n")
+		break
+	case (EXECUTE_KEY_NOT_FOUND):
+		fmt.Printf("Error: Key not found.\n")
+		break
+	case (EXECUTE_TRANSACTION_ACTIVE):
+		fmt.Printf("Error: A transaction is active.\n")
+		break
+	case (EXECUTE_NO_TRANSACTION):
+		fmt.Printf("Error: No transaction is active.\n")
+		break
+	case (EXECUTE_NO_SUCH_SAVEPOINT):
+		fmt.Printf("Error: No such savepoint.\n")
+		break
+	case (EXECUTE_DATABASE_LOCKED):
+		fmt.Printf("Error: Database is locked.\n")
+		break
+	}
+}
+
+/*
+ * Abandon a command that read a page failing its checksum. What the
+ * command, and the transaction it was part of, changed is rolled back and
+ * the locks are released, so other commands can still run and the
+ * database is closed cleanly.
+ */
+func abandon_corrupt_command(table *Table) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	corruption, ok := r.(PageCorruption)
+	if !ok {
+		panic(r)
+	}
+	fmt.Printf("Error: Checksum mismatch on page %d.\n", corruption.pageNum)
+	table.inTransaction = false
+	pager_rollback(table.pager)
+	pager_drop_cache(table.pager)
+	pager_unlock(table.pager)
+}
+
+/*
+ * Send each line of input to the REPL and close the channel at end of input
+ */
+func read_commands(reader *bufio.Reader, commands chan<- string) {
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			commands <- line
+		}
+		if err != nil {
+			close(commands)
+			return
 		}
 	}
 }
@@ -199,13 +722,57 @@ func print_prompt() {
 	fmt.Print("db > ")
 }
 
+func is_valid_page_size(pageSize uint) bool {
+	return pageSize >= MIN_PAGE_SIZE && pageSize <= MAX_PAGE_SIZE && pageSize&(pageSize-1) == 0
+}
+
+/*
+ * Derive the node layout from the page size of the open database
+ */
+func configure_page_layout(pageSize uint32) {
+	PAGE_SIZE = pageSize
+	PAGE_USABLE_SIZE = PAGE_SIZE - PAGE_TRAILER_SIZE
+	FREELIST_TRUNK_MAX_LEAVES = (PAGE_USABLE_SIZE - FREELIST_TRUNK_HEADER_SIZE) / FREELIST_LEAF_SIZE
+	LEAF_NODE_SPACE_FOR_CELLS = PAGE_USABLE_SIZE - LEAF_NODE_HEADER_SIZE
+	// At least four cells fit in a leaf, so a split always leaves two non-empty leaves
+	LEAF_NODE_MAX_LOCAL_PAYLOAD = LEAF_NODE_SPACE_FOR_CELLS/4 - LEAF_NODE_CELL_POINTER_SIZE - LEAF_NODE_CELL_HEADER_SIZE - MAX_KEY_SIZE - LEAF_NODE_OVERFLOW_PAGE_SIZE
+	LEAF_NODE_MIN_USED_SPACE = LEAF_NODE_SPACE_FOR_CELLS / 4
+	OVERFLOW_PAGE_DATA_SIZE = PAGE_USABLE_SIZE - OVERFLOW_HEADER_SIZE
+	INTERNAL_NODE_MAX_CELLS = (PAGE_USABLE_SIZE - INTERNAL_NODE_HEADER_SIZE) / INTERNAL_NODE_CELL_SIZE
+	INTERNAL_NODE_MIN_CELLS = INTERNAL_NODE_MAX_CELLS / 2
+}
+
 func print_constants() {
-	fmt.Printf("ROW_SIZE: %d\n", ROW_SIZE)
+	fmt.Printf("PAGE_SIZE: %d\n", PAGE_SIZE)
+	fmt.Printf("PAGE_USABLE_SIZE: %d\n", PAGE_USABLE_SIZE)
 	fmt.Printf("COMMON_NODE_HEADER_SIZE: %d\n", COMMON_NODE_HEADER_SIZE)
 	fmt.Printf("LEAF_NODE_HEADER_SIZE: %d\n", LEAF_NODE_HEADER_SIZE)
-	fmt.Printf("LEAF_NODE_CELL_SIZE: %d\n", LEAF_NODE_CELL_SIZE)
+	fmt.Printf("LEAF_NODE_CELL_HEADER_SIZE: %d\n", LEAF_NODE_CELL_HEADER_SIZE)
 	fmt.Printf("LEAF_NODE_SPACE_FOR_CELLS: %d\n", LEAF_NODE_SPACE_FOR_CELLS)
-	fmt.Printf("LEAF_NODE_MAX_CELLS: %d\n", LEAF_NODE_MAX_CELLS)
+	fmt.Printf("LEAF_NODE_MAX_LOCAL_PAYLOAD: %d\n", LEAF_NODE_MAX_LOCAL_PAYLOAD)
+	fmt.Printf("OVERFLOW_PAGE_DATA_SIZE: %d\n", OVERFLOW_PAGE_DATA_SIZE)
+	fmt.Printf("MAX_KEY_SIZE: %d\n", MAX_KEY_SIZE)
+	fmt.Printf("INTERNAL_NODE_MAX_CELLS: %d\n", INTERNAL_NODE_MAX_CELLS)
+}
+
+func print_db_info(pager *Pager) {
+	header := get_page(pager, HEADER_PAGE_NUM)
+	fmt.Printf("format version: %d\n", header_format_version(header))
+	fmt.Printf("page size: %d\n", header_page_size(header))
+	fmt.Printf("page count: %d\n", pager.numPages)
+	fmt.Printf("root page: %d\n", header_root_page(header))
+	fmt.Printf("freelist trunk page: %d\n", freelist_trunk_page(header))
+	fmt.Printf("freelist page count: %d\n", freelist_page_count(header))
+	fmt.Printf("schema cookie: %d\n", header_schema_cookie(header))
+	fmt.Printf("key type: %s\n", key_types_name(read_key_types(header)))
+}
+
+func print_stats(pager *Pager) {
+	fmt.Printf("cache hits: %d\n", pager.stats.cacheHits)
+	fmt.Printf("pages read: %d\n", pager.stats.pageReads)
+	fmt.Printf("pages written: %d\n", pager.stats.pageWrites)
+	fmt.Printf("journal pages written: %d\n", pager.stats.journalWrites)
+	fmt.Printf("wal frames written: %d\n", pager.stats.walWrites)
 }
 
 func indent(level uint32) {
@@ -219,368 +786,3800 @@ func print_tree(pager *Pager, pageNum uint32, indentationLevel uint32) {
 
 	switch get_node_type(node) {
 	case NODE_LEAF:
-		numKeys := *leaf_node_num_cells(node)
+		numKeys := leaf_node_num_cells(node)
 		indent(indentationLevel)
 		fmt.Printf("- leaf (size %d)\n", numKeys)
 		for i := uint32(0); i < numKeys; i++ {
 			indent(indentationLevel + 1)
 
-			fmt.Printf("- %d\n", *leaf_node_cell_key(node, i))
+			fmt.Printf("- %s\n", format_key(leaf_node_cell_key(node, i)))
 		}
 		break
 	case NODE_INTERNAL:
-		numKeys := *internal_node_num_keys(node)
+		numKeys := internal_node_num_keys(node)
 		indent(indentationLevel)
 		fmt.Printf("- internal (size %d)\n", numKeys)
 		for i := uint32(0); i < numKeys; i++ {
-			child := *internal_node_child(node, i)
+			child := internal_node_child(node, i)
 			print_tree(pager, child, indentationLevel+1)
 			indent(indentationLevel + 1)
-			fmt.Printf("- key %d\n", *internal_node_cell_key(node, i))
+			fmt.Printf("- key %s\n", format_key(internal_node_cell_key(node, i)))
 		}
-		child := *internal_node_right_child(node)
+		child := internal_node_right_child(node)
 		print_tree(pager, child, indentationLevel+1)
 		break
 	}
 }
 
-func do_meta_command(command string, table *Table) MetaCommandResult {
-	if strings.Compare(".exit", command) == 0 {
-		db_close(table)
-		os.Exit(0)
-	} else if strings.Compare(".btree", command) == 0 {
-		fmt.Printf("Tree:\n")
-		print_tree(table.pager, 0, 0)
-		return META_COMMAND_SUCCESS
-	} else if strings.Compare(".constants", command) == 0 {
-		fmt.Printf("Constants:\n")
-		print_constants()
-		return META_COMMAND_SUCCESS
-	} else {
-		return META_COMMAND_UNRECOGNIZED
+/*
+ * Verify the structure of the whole database file and print every
+ * violation found, or "ok" when there is none
+ */
+func integrity_check(table *Table) {
+	pager := table.pager
+	check := &IntegrityCheck{}
+	check.table = table
+	check.pageUsed = make([]bool, pager.numPages)
+	check.corrupt = make([]bool, pager.numPages)
+	check.leafDepth = -1
+
+	/* Pages that fail their checksum are reported first and then skipped */
+	numCorrupt := 0
+	for pageNum := uint32(1); pageNum < pager.numPages; pageNum++ {
+		if _, cached := pager.pages[pageNum]; cached {
+			continue
+		}
+		if _, ok := pager_read_page(pager, pageNum); !ok {
+			check_error(check, "Page %d: checksum mismatch.", pageNum)
+			check.corrupt[pageNum] = true
+			numCorrupt++
+		}
 	}
-	return META_COMMAND_UNRECOGNIZED
-}
 
-func prepare_statement(cmdStr string, statement *Statement) PrepareStatementResult {
-	cmdArgs := strings.Split(cmdStr, " ")
+	if check_page_ref(check, table.rootPageNum) {
+		check_node(check, table.rootPageNum, 0, nil, nil, 0)
+	}
 
-	if strings.Compare(cmdArgs[0], "insert") == 0 {
-		statement.statementType = STATEMENT_INSERT
-		args, _ := fmt.Sscanf(cmdStr, "insert %d %s %s", &statement.rowToInsert.id, &statement.rowToInsert.username, &statement.rowToInsert.email)
-		if args < 3 {
-			return PREPARE_SYNTAX_ERROR
+	/* Every leaf must point to the next one in key order */
+	for i, pageNum := range check.leaves {
+		if numCorrupt > 0 {
+			break
 		}
-		if len(statement.rowToInsert.username) > USER_NAME_SIZE {
-			return PREPARE_STRING_TOO_LONG
+		expected := uint32(0)
+		if i+1 < len(check.leaves) {
+			expected = check.leaves[i+1]
 		}
-		if len(statement.rowToInsert.email) > EMAIL_SIZE {
-			return PREPARE_STRING_TOO_LONG
+		nextPageNum := leaf_node_next_leaf(get_page(pager, pageNum))
+		if nextPageNum != expected {
+			check_error(check, "Page %d: next leaf is %d, expected %d.", pageNum, nextPageNum, expected)
 		}
-		return PREPARE_STATEMENT_SUCCESS
 	}
-	if strings.Compare(cmdArgs[0], "select") == 0 {
-		statement.statementType = STATEMENT_SELECT
-		return PREPARE_STATEMENT_SUCCESS
+
+	check_free_list(check)
+
+	/* The pages referenced by a corrupt page are unknown */
+	for pageNum := uint32(1); pageNum < pager.numPages && numCorrupt == 0; pageNum++ {
+		if !check.pageUsed[pageNum] {
+			check_error(check, "Page %d is never used.", pageNum)
+		}
 	}
-	return PREPARE_STATEMENT_UNRECOGNIZED
-}
 
-func execute_statement(statement *Statement, table *Table) ExecuteResult {
-	switch statement.statementType {
-	case (STATEMENT_INSERT):
-		return execute_insert(statement, table)
-	case (STATEMENT_SELECT):
-		return execute_select(statement, table)
+	if check.numErrors == 0 {
+		fmt.Printf("ok\n")
 	}
-	return EXECUTE_FAILURE
 }
 
-func serialize_row(src *Row) []byte {
-	idBytes := make([]byte, ID_SIZE)
-	binary.LittleEndian.PutUint32(idBytes, uint32(src.id))
-	usernameBytes := make([]byte, USER_NAME_SIZE)
-	copy(usernameBytes, src.username)
-	emailBytes := make([]byte, EMAIL_SIZE)
-	copy(emailBytes, src.email)
-	return bytes.Join([][]byte{idBytes, usernameBytes, emailBytes}, []byte{})
+func check_error(check *IntegrityCheck, format string, args ...any) {
+	fmt.Printf(format+"\n", args...)
+	check.numErrors++
 }
 
-func deserialize_row(src []byte) Row {
-	var dst Row
-	binary.Read(bytes.NewBuffer(src[ID_OFFSET:USER_NAME_OFFSET]), binary.LittleEndian, &dst.id)
-	dst.username = string(bytes.Trim(src[USER_NAME_OFFSET:EMAIL_OFFSET], "\x00"))
-	dst.email = string(bytes.Trim(src[EMAIL_OFFSET:], "\x00"))
-	return dst
+/*
+ * Record a reference to a page. Return false when the page can not
+ * be used, because it is out of bounds or referenced already.
+ */
+func check_page_ref(check *IntegrityCheck, pageNum uint32) bool {
+	if pageNum == HEADER_PAGE_NUM || pageNum >= check.table.pager.numPages {
+		check_error(check, "Page %d is out of bounds.", pageNum)
+		return false
+	}
+	if check.pageUsed[pageNum] {
+		check_error(check, "Page %d is referenced more than once.", pageNum)
+		return false
+	}
+	check.pageUsed[pageNum] = true
+	return true
 }
 
-func cursor_value(cursor *Cursor) []byte {
-	pagenum := cursor.pageNum
-	page := get_page(cursor.table.pager, pagenum)
-	return leaf_node_cell_value(page, cursor.cellNum)
+/*
+ * Check the subtree rooted at pageNum, whose keys must be greater than
+ * lower and at most upper (nil for no bound). Return its max key.
+ */
+func check_node(check *IntegrityCheck, pageNum uint32, parentPageNum uint32, lower []byte, upper []byte, depth int) []byte {
+	if check.corrupt[pageNum] {
+		return nil
+	}
+	node := get_page(check.table.pager, pageNum)
+	isRoot := pageNum == check.table.rootPageNum
+	if is_node_root(node) != isRoot {
+		check_error(check, "Page %d: root flag is %t, expected %t.", pageNum, is_node_root(node), isRoot)
+	}
+	if !isRoot && node_parent(node) != parentPageNum {
+		check_error(check, "Page %d: parent is %d, expected %d.", pageNum, node_parent(node), parentPageNum)
+	}
+
+	switch get_node_type(node) {
+	case NODE_LEAF:
+		return check_leaf_node(check, pageNum, node, lower, upper, depth)
+	case NODE_INTERNAL:
+		return check_internal_node(check, pageNum, node, lower, upper, depth)
+	}
+	check_error(check, "Page %d: unknown node type %d.", pageNum, get_node_type(node))
+	return nil
 }
 
-func execute_insert(statement *Statement, table *Table) ExecuteResult {
-	node := get_page(table.pager, table.rootPageNum)
-	numCells := *leaf_node_num_cells(node)
+func check_leaf_node(check *IntegrityCheck, pageNum uint32, node []byte, lower []byte, upper []byte, depth int) []byte {
+	if check.leafDepth == -1 {
+		check.leafDepth = depth
+	} else if depth != check.leafDepth {
+		check_error(check, "Page %d: leaf is at depth %d, expected %d.", pageNum, depth, check.leafDepth)
+	}
+	check.leaves = append(check.leaves, pageNum)
 
-	keyToInsert := statement.rowToInsert.id
-	cursor := table_find(table, keyToInsert)
+	numCells := leaf_node_num_cells(node)
+	contentStart := leaf_node_cell_content_start(node)
+	if LEAF_NODE_HEADER_SIZE+numCells*LEAF_NODE_CELL_POINTER_SIZE > contentStart || contentStart > PAGE_USABLE_SIZE {
+		check_error(check, "Page %d: cell count %d is out of bounds.", pageNum, numCells)
+		return nil
+	}
+	if numCells == 0 && pageNum != check.table.rootPageNum {
+		check_error(check, "Page %d: non-root leaf is empty.", pageNum)
+	}
 
-	if cursor.cellNum < numCells {
-		// check whether the key exists
-		keyAtIndex := *leaf_node_cell_key(node, cursor.cellNum)
-		if keyAtIndex == keyToInsert {
-			return EXECUTE_DUPLICATE_KEY
+	var previous []byte
+	for i := uint32(0); i < numCells; i++ {
+		offset := uint32(leaf_node_cell_pointer(node, i))
+		if offset < contentStart || offset+LEAF_NODE_CELL_HEADER_SIZE > PAGE_USABLE_SIZE {
+			check_error(check, "Page %d: cell %d is out of bounds.", pageNum, i)
+			return previous
 		}
+		cell := node[offset:PAGE_USABLE_SIZE]
+		keySize := uint32(leaf_cell_key_size(cell))
+		if keySize > MAX_KEY_SIZE || leaf_cell_size(keySize, leaf_cell_payload_size(cell)) > uint32(len(cell)) {
+			check_error(check, "Page %d: cell %d is out of bounds.", pageNum, i)
+			return previous
+		}
+		key := leaf_cell_key(cell)
+		if !key_is_valid(check.table.keyTypes, key) {
+			check_error(check, "Page %d: cell %d has a malformed key.", pageNum, i)
+			return previous
+		}
+		if previous != nil && check.table.compareKeys(previous, key) >= 0 {
+			check_error(check, "Page %d: keys out of order at cell %d.", pageNum, i)
+		}
+		check_key_range(check, pageNum, key, lower, upper)
+		check_overflow_chain(check, pageNum, i, cell)
+		previous = key
 	}
-	leaf_node_insert(cursor, statement.rowToInsert.id, statement.rowToInsert)
-	return EXECUTE_SUCCESS
+	return append([]byte(nil), previous...)
 }
 
-func execute_select(statement *Statement, table *Table) ExecuteResult {
-	cursor := table_start(table)
+func check_internal_node(check *IntegrityCheck, pageNum uint32, node []byte, lower []byte, upper []byte, depth int) []byte {
+	numKeys := internal_node_num_keys(node)
+	minKeys := INTERNAL_NODE_MIN_CELLS
+	if pageNum == check.table.rootPageNum {
+		minKeys = 1
+	}
+	if numKeys < minKeys || numKeys > INTERNAL_NODE_MAX_CELLS {
+		check_error(check, "Page %d: key count %d is out of bounds.", pageNum, numKeys)
+		return nil
+	}
 
-	for !cursor.endOfTable {
-		row := deserialize_row(cursor_value(cursor))
-		fmt.Println(row)
-		cursor_advance(cursor)
+	childLower := lower
+	var maxKey []byte
+	for i := uint32(0); i <= numKeys; i++ {
+		childUpper := upper
+		var key []byte
+		if i < numKeys {
+			if internal_node_key_size(node, i) > MAX_KEY_SIZE || !key_is_valid(check.table.keyTypes, internal_node_cell_key(node, i)) {
+				check_error(check, "Page %d: key %d is malformed.", pageNum, i)
+				return nil
+			}
+			key = append([]byte(nil), internal_node_cell_key(node, i)...)
+			if i > 0 && check.table.compareKeys(childLower, key) >= 0 {
+				check_error(check, "Page %d: keys out of order at key %d.", pageNum, i)
+			}
+			check_key_range(check, pageNum, key, lower, upper)
+			childUpper = key
+		}
+
+		childPageNum := internal_node_child(node, i)
+		maxKey = nil
+		if check_page_ref(check, childPageNum) {
+			maxKey = check_node(check, childPageNum, pageNum, childLower, childUpper, depth+1)
+			if key != nil && maxKey != nil && check.table.compareKeys(maxKey, key) != 0 {
+				check_error(check, "Page %d: key %d is %s, but the max key of child %d is %s.", pageNum, i, format_key(key), childPageNum, format_key(maxKey))
+			}
+		}
+		if key != nil {
+			childLower = key
+		}
 	}
-	return EXECUTE_SUCCESS
+	return maxKey
 }
 
-func db_open(filename string) *Table {
-	pager := pager_open(filename)
-	table := new(Table)
-	table.pager = pager
-	table.rootPageNum = 0
-	if pager.numPages == 0 {
-		// New database file. Initial page 0 as leaf node
-		rootNode := get_page(pager, 0)
-		initialize_leaf_node(rootNode)
-		set_node_root(rootNode, true)
+func check_key_range(check *IntegrityCheck, pageNum uint32, key []byte, lower []byte, upper []byte) {
+	compareKeys := check.table.compareKeys
+	if (lower != nil && compareKeys(key, lower) <= 0) || (upper != nil && compareKeys(key, upper) > 0) {
+		check_error(check, "Page %d: key %s is outside the range of its parent.", pageNum, format_key(key))
 	}
-	return table
 }
 
-func db_close(table *Table) {
-	pager := table.pager
+/*
+ * Check that the overflow chain of a cell is exactly as long as its spilled payload
+ */
+func check_overflow_chain(check *IntegrityCheck, pageNum uint32, cellNum uint32, cell []byte) {
+	payloadSize := leaf_cell_payload_size(cell)
+	if payloadSize <= LEAF_NODE_MAX_LOCAL_PAYLOAD {
+		return
+	}
 
-	for i := uint32(0); i < pager.numPages; i++ {
-		if pager.pages[i] == nil {
-			continue
+	remaining := payloadSize - LEAF_NODE_MAX_LOCAL_PAYLOAD
+	overflowPageNum := leaf_cell_overflow_page(cell)
+	for remaining > 0 {
+		if overflowPageNum == 0 {
+			check_error(check, "Page %d: overflow chain of cell %d is shorter than its payload.", pageNum, cellNum)
+			return
 		}
-		pager_flush(pager, i)
-		pager.pages[i] = nil
+		if !check_page_ref(check, overflowPageNum) || check.corrupt[overflowPageNum] {
+			return
+		}
+		remaining -= min(remaining, OVERFLOW_PAGE_DATA_SIZE)
+		overflowPageNum = overflow_next_page(get_page(check.table.pager, overflowPageNum))
+	}
+	if overflowPageNum != 0 {
+		check_error(check, "Page %d: overflow chain of cell %d is longer than its payload.", pageNum, cellNum)
 	}
+}
 
-	pager_close(pager)
+func check_free_list(check *IntegrityCheck) {
+	pager := check.table.pager
+	header := get_page(pager, HEADER_PAGE_NUM)
+	numPages := uint32(0)
+	trunkPageNum := freelist_trunk_page(header)
+	for trunkPageNum != 0 && check_page_ref(check, trunkPageNum) {
+		numPages++
+		if check.corrupt[trunkPageNum] {
+			return
+		}
+		trunk := get_page(pager, trunkPageNum)
+		numLeaves := freelist_num_leaves(trunk)
+		if numLeaves > FREELIST_TRUNK_MAX_LEAVES {
+			check_error(check, "Page %d: free list trunk has %d leaves, at most %d fit.", trunkPageNum, numLeaves, FREELIST_TRUNK_MAX_LEAVES)
+			break
+		}
+		for i := uint32(0); i < numLeaves; i++ {
+			if check_page_ref(check, freelist_leaf(trunk, i)) {
+				numPages++
+			}
+		}
+		trunkPageNum = freelist_next_trunk(trunk)
+	}
+	if numPages != freelist_page_count(header) {
+		check_error(check, "Free list has %d pages, header records %d.", numPages, freelist_page_count(header))
+	}
 }
 
-func pager_open(filename string) *Pager {
-	// Read the persistent file
-	fd, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		fmt.Printf("Unable to open file.\n")
-		os.Exit(1)
+func do_meta_command(command string, table *Table) MetaCommandResult {
+	if strings.Compare(".exit", command) == 0 {
+		db_close(table)
+		os.Exit(0)
+	} else if strings.Compare(".btree", command) == 0 {
+		if table_lock(table, LOCK_SHARED) {
+			fmt.Printf("Tree:\n")
+			print_tree(table.pager, table.rootPageNum, 0)
+		}
+		autocommit(table)
+		return META_COMMAND_SUCCESS
+	} else if strings.Compare(".dbinfo", command) == 0 {
+		if table_lock(table, LOCK_SHARED) {
+			print_db_info(table.pager)
+		}
+		autocommit(table)
+		return META_COMMAND_SUCCESS
+	} else if strings.Compare(".check", command) == 0 {
+		if table_lock(table, LOCK_SHARED) {
+			integrity_check(table)
+		}
+		autocommit(table)
+		return META_COMMAND_SUCCESS
+	} else if strings.Compare(".load", strings.Fields(command)[0]) == 0 {
+		if table_lock(table, LOCK_RESERVED) {
+			load_command(table, strings.Fields(command)[1:])
+		}
+		if autocommit(table) == EXECUTE_DATABASE_LOCKED {
+			fmt.Printf("Error: Database is locked.\n")
+		}
+		return META_COMMAND_SUCCESS
+	} else if strings.Compare(".checkpoint", command) == 0 {
+		if table.pager.walFile == nil {
+			fmt.Printf("Error: Database is not in WAL mode.\n")
+			return META_COMMAND_SUCCESS
+		}
+		if table.inTransaction {
+			fmt.Printf("Error: A transaction is active.\n")
+			return META_COMMAND_SUCCESS
+		}
+		pager_commit(table.pager)
+		if pager_lock(table.pager, LOCK_EXCLUSIVE) {
+			fmt.Printf("Checkpointed %d pages.\n", pager_checkpoint(table.pager))
+		} else {
+			fmt.Printf("Error: Database is locked.\n")
+		}
+		pager_unlock(table.pager)
+		return META_COMMAND_SUCCESS
+	} else if strings.Compare(".stats", command) == 0 {
+		print_stats(table.pager)
+		return META_COMMAND_SUCCESS
+	} else if strings.Compare(".constants", command) == 0 {
+		fmt.Printf("Constants:\n")
+		print_constants()
+		return META_COMMAND_SUCCESS
+	} else {
+		return META_COMMAND_UNRECOGNIZED
 	}
-	offset, err := fd.Seek(0, 2)
-	if offset%PAGE_SIZE != 0 {
-		fmt.Printf("DB file is not a whole number of pages.\n")
-		os.Exit(1)
+	return META_COMMAND_UNRECOGNIZED
+}
+
+func prepare_statement(cmdStr string, statement *Statement, table *Table) PrepareStatementResult {
+	cmdArgs := strings.Split(cmdStr, " ")
+
+	if strings.Compare(cmdArgs[0], "insert") == 0 {
+		statement.statementType = STATEMENT_INSERT
+		return prepare_row(table, strings.TrimPrefix(cmdStr, "insert"), statement.rowToInsert)
 	}
-	// Init the pager based on the persistent file
-	pager := new(Pager)
-	pager.fileDescriptor = fd
-	pager.fileLength = uint32(offset)
-	pager.numPages = uint32(offset / PAGE_SIZE)
+	if strings.Compare(cmdArgs[0], "select") == 0 {
+		statement.statementType = STATEMENT_SELECT
+		return prepare_select(cmdArgs[1:], statement, table)
+	}
+	if strings.Compare(cmdArgs[0], "delete") == 0 {
+		statement.statementType = STATEMENT_DELETE
+		var key string
+		args, _ := fmt.Sscanf(cmdStr, "delete %s", &key)
+		if args < 1 {
+			return PREPARE_SYNTAX_ERROR
+		}
+		return prepare_key(table, key, &statement.keyToDelete)
+	}
+	if strings.Compare(cmdStr, "vacuum") == 0 {
+		statement.statementType = STATEMENT_VACUUM
+		return PREPARE_STATEMENT_SUCCESS
+	}
+	if strings.Compare(cmdStr, "begin") == 0 {
+		statement.statementType = STATEMENT_BEGIN
+		return PREPARE_STATEMENT_SUCCESS
+	}
+	if strings.Compare(cmdStr, "commit") == 0 {
+		statement.statementType = STATEMENT_COMMIT
+		return PREPARE_STATEMENT_SUCCESS
+	}
+	if strings.Compare(cmdStr, "rollback") == 0 {
+		statement.statementType = STATEMENT_ROLLBACK
+		return PREPARE_STATEMENT_SUCCESS
+	}
+	if strings.Compare(cmdArgs[0], "savepoint") == 0 {
+		statement.statementType = STATEMENT_SAVEPOINT
+		return prepare_savepoint_name(cmdArgs[1:], statement)
+	}
+	if strings.Compare(cmdArgs[0], "release") == 0 {
+		statement.statementType = STATEMENT_RELEASE
+		return prepare_savepoint_name(cmdArgs[1:], statement)
+	}
+	if strings.Compare(cmdArgs[0], "rollback") == 0 && len(cmdArgs) > 1 && strings.Compare(cmdArgs[1], "to") == 0 {
+		statement.statementType = STATEMENT_ROLLBACK_TO
+		return prepare_savepoint_name(cmdArgs[2:], statement)
+	}
+	if strings.Compare(cmdArgs[0], "update") == 0 {
+		statement.statementType = STATEMENT_UPDATE
+		return prepare_update(cmdArgs[1:], statement, table)
+	}
+	return PREPARE_STATEMENT_UNRECOGNIZED
+}
 
-	pager.pages = make([][]byte, TABLE_MAX_PAGES)
+func prepare_savepoint_name(args []string, statement *Statement) PrepareStatementResult {
+	if len(args) != 1 || args[0] == "" {
+		return PREPARE_SYNTAX_ERROR
+	}
+	statement.savepointName = args[0]
+	return PREPARE_STATEMENT_SUCCESS
+}
 
-	return pager
+/*
+ * Parse "set column=value [column=value ...] [where column=value]"
+ */
+func prepare_update(args []string, statement *Statement, table *Table) PrepareStatementResult {
+	if len(args) < 2 || strings.Compare(args[0], "set") != 0 {
+		return PREPARE_SYNTAX_ERROR
+	}
+	args = args[1:]
+	for len(args) > 0 && strings.Compare(args[0], "where") != 0 {
+		assignment := Assignment{}
+		result := prepare_column_value(table, args[0], &assignment.column, &assignment.value, &assignment.key)
+		if result != PREPARE_STATEMENT_SUCCESS {
+			return result
+		}
+		statement.assignments = append(statement.assignments, assignment)
+		args = args[1:]
+	}
+	if len(statement.assignments) == 0 {
+		return PREPARE_SYNTAX_ERROR
+	}
+	if len(args) == 0 {
+		return PREPARE_STATEMENT_SUCCESS
+	}
+	if len(args) != 2 {
+		return PREPARE_SYNTAX_ERROR
+	}
+	statement.predicate = &Predicate{}
+	predicate := statement.predicate
+	return prepare_column_value(table, args[1], &predicate.column, &predicate.value, &predicate.key)
 }
 
-func pager_close(pager *Pager) {
-	if err := pager.fileDescriptor.Close(); err != nil {
-		fmt.Printf("Error closing db file. %v.\n", err)
-		os.Exit(1)
+/*
+ * Parse "[where CONDITION [and CONDITION ...]] [order by id [asc|desc]] [limit N]"
+ */
+func prepare_select(args []string, statement *Statement, table *Table) PrepareStatementResult {
+	statement.limit = -1
+	if len(args) > 0 && strings.Compare(args[0], "where") == 0 {
+		var result PrepareStatementResult
+		args, result = prepare_key_conditions(args[1:], &statement.keyRange, table)
+		if result != PREPARE_STATEMENT_SUCCESS {
+			return result
+		}
 	}
+	if len(args) >= 3 && strings.Compare(args[0], "order") == 0 && strings.Compare(args[1], "by") == 0 && strings.Compare(args[2], "id") == 0 {
+		args = args[3:]
+		if len(args) > 0 && (strings.Compare(args[0], "asc") == 0 || strings.Compare(args[0], "desc") == 0) {
+			statement.descending = strings.Compare(args[0], "desc") == 0
+			args = args[1:]
+		}
+	}
+	if len(args) >= 2 && strings.Compare(args[0], "limit") == 0 {
+		limit, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return PREPARE_SYNTAX_ERROR
+		}
+		statement.limit = int64(limit)
+		args = args[2:]
+	}
+	if len(args) != 0 {
+		return PREPARE_SYNTAX_ERROR
+	}
+	return PREPARE_STATEMENT_SUCCESS
 }
 
-func get_page(pager *Pager, pagenum uint32) []byte {
-	if pagenum > TABLE_MAX_PAGES {
-		fmt.Printf("Tried to fetch page number out of bounds. %d > %d\n", pagenum, TABLE_MAX_PAGES)
+/*
+ * Parse conditions "id OP value" joined by "and", where OP is one of
+ * =, <, <=, > and >=, into a range of keys. Return the arguments after them.
+ */
+func prepare_key_conditions(args []string, keyRange *KeyRange, table *Table) ([]string, PrepareStatementResult) {
+	for {
+		if len(args) < 3 || strings.Compare(args[0], "id") != 0 {
+			return args, PREPARE_SYNTAX_ERROR
+		}
+		var key []byte
+		if result := prepare_key(table, args[2], &key); result != PREPARE_STATEMENT_SUCCESS {
+			return args, result
+		}
+		switch args[1] {
+		case "=":
+			key_range_restrict_lower(table, keyRange, key, true)
+			key_range_restrict_upper(table, keyRange, key, true)
+		case ">":
+			key_range_restrict_lower(table, keyRange, key, false)
+		case ">=":
+			key_range_restrict_lower(table, keyRange, key, true)
+		case "<":
+			key_range_restrict_upper(table, keyRange, key, false)
+		case "<=":
+			key_range_restrict_upper(table, keyRange, key, true)
+		default:
+			return args, PREPARE_SYNTAX_ERROR
+		}
+
+		args = args[3:]
+		if len(args) == 0 || strings.Compare(args[0], "and") != 0 {
+			return args, PREPARE_STATEMENT_SUCCESS
+		}
+		args = args[1:]
 	}
+}
 
-	if pager.pages[pagenum] == nil {
-		// Cache miss. Allocate memory and load from file
-		pager.pages[pagenum] = make([]byte, PAGE_SIZE)
-		totalpages := pager.fileLength / PAGE_SIZE
-		if pager.fileLength%PAGE_SIZE != 0 {
-			totalpages += 1
+/*
+ * Raise the lower bound of the range to the key, unless it is higher already
+ */
+func key_range_restrict_lower(table *Table, keyRange *KeyRange, key []byte, inclusive bool) {
+	if keyRange.lower != nil {
+		order := table.compareKeys(key, keyRange.lower)
+		if order < 0 || (order == 0 && inclusive) {
+			return
 		}
+	}
+	keyRange.lower = key
+	keyRange.lowerInclusive = inclusive
+}
 
-		// Load the bytes to page if the page num exists in the persistent file
-		if pagenum < totalpages {
-			pager.fileDescriptor.Seek(int64(PAGE_SIZE*pagenum), 0)
-			_, err := pager.fileDescriptor.Read(pager.pages[pagenum])
-			if err != nil {
-				fmt.Printf("Error reading file. %v\n", err)
-				os.Exit(1)
+/*
+ * Lower the upper bound of the range to the key, unless it is lower already
+ */
+func key_range_restrict_upper(table *Table, keyRange *KeyRange, key []byte, inclusive bool) {
+	if keyRange.upper != nil {
+		order := table.compareKeys(key, keyRange.upper)
+		if order > 0 || (order == 0 && inclusive) {
+			return
+		}
+	}
+	keyRange.upper = key
+	keyRange.upperInclusive = inclusive
+}
+
+/*
+ * Parse "column=value", encoding the value as a key for the id column
+ */
+func prepare_column_value(table *Table, arg string, column *Column, value *string, key *[]byte) PrepareStatementResult {
+	name, literal, found := strings.Cut(arg, "=")
+	if !found || literal == "" {
+		return PREPARE_SYNTAX_ERROR
+	}
+	var ok bool
+	*column, ok = COLUMN_NAMES[name]
+	if !ok {
+		return PREPARE_SYNTAX_ERROR
+	}
+	*value = literal
+	if *column == COLUMN_ID {
+		return prepare_key(table, literal, key)
+	}
+	return PREPARE_STATEMENT_SUCCESS
+}
+
+/*
+ * Parse the key, username and email of a row separated by spaces
+ */
+func prepare_row(table *Table, values string, row *Row) PrepareStatementResult {
+	var key string
+	args, _ := fmt.Sscanf(values, "%s %s %s", &key, &row.username, &row.email)
+	if args < 3 {
+		return PREPARE_SYNTAX_ERROR
+	}
+	return prepare_key(table, key, &row.key)
+}
+
+/*
+ * Encode the key written in a statement for the key type of the table
+ */
+func prepare_key(table *Table, literal string, key *[]byte) PrepareStatementResult {
+	encoded, ok := encode_key(table.keyTypes, literal)
+	if !ok {
+		return PREPARE_SYNTAX_ERROR
+	}
+	if len(encoded) > MAX_KEY_SIZE {
+		return PREPARE_KEY_TOO_LONG
+	}
+	*key = encoded
+	return PREPARE_STATEMENT_SUCCESS
+}
+
+func execute_statement(statement *Statement, table *Table) ExecuteResult {
+	result := EXECUTE_FAILURE
+	if !table_lock(table, statement_lock_level(statement)) {
+		result = EXECUTE_DATABASE_LOCKED
+		autocommit(table)
+		return result
+	}
+	switch statement.statementType {
+	case (STATEMENT_INSERT):
+		result = execute_insert(statement, table)
+	case (STATEMENT_SELECT):
+		result = execute_select(statement, table)
+	case (STATEMENT_DELETE):
+		result = execute_delete(statement, table)
+	case (STATEMENT_UPDATE):
+		result = execute_update(statement, table)
+	case (STATEMENT_VACUUM):
+		result = execute_vacuum(table)
+	case (STATEMENT_BEGIN):
+		result = execute_begin(table)
+	case (STATEMENT_COMMIT):
+		result = execute_commit(table)
+	case (STATEMENT_ROLLBACK):
+		result = execute_rollback(table)
+	case (STATEMENT_SAVEPOINT):
+		result = execute_savepoint(statement, table)
+	case (STATEMENT_RELEASE):
+		result = execute_release(statement, table)
+	case (STATEMENT_ROLLBACK_TO):
+		result = execute_rollback_to(statement, table)
+	}
+	if autocommit(table) == EXECUTE_DATABASE_LOCKED {
+		result = EXECUTE_DATABASE_LOCKED
+	}
+	return result
+}
+
+/*
+ * Return the lock a statement needs before it runs. Statements that write
+ * take the reserved lock up front, so they fail before changing anything
+ * when another process is writing.
+ */
+func statement_lock_level(statement *Statement) LockLevel {
+	switch statement.statementType {
+	case STATEMENT_SELECT:
+		return LOCK_SHARED
+	case STATEMENT_INSERT, STATEMENT_DELETE, STATEMENT_UPDATE, STATEMENT_VACUUM:
+		return LOCK_RESERVED
+	}
+	return LOCK_NONE
+}
+
+/*
+ * Take a lock on the database file for the table. Another process may
+ * have changed the file since the last lock, so the root page is read again.
+ */
+func table_lock(table *Table, level LockLevel) bool {
+	if level == LOCK_NONE {
+		return true
+	}
+	if !pager_lock(table.pager, level) {
+		return false
+	}
+	table.rootPageNum = header_root_page(get_page(table.pager, HEADER_PAGE_NUM))
+	return true
+}
+
+/*
+ * Commit the changes of the last statement unless a transaction groups it
+ * with the following ones, and let other processes in. A statement whose
+ * changes cannot be committed because other processes are reading is
+ * rolled back.
+ */
+func autocommit(table *Table) ExecuteResult {
+	if table.inTransaction {
+		return EXECUTE_SUCCESS
+	}
+	result := EXECUTE_SUCCESS
+	if !pager_commit(table.pager) {
+		pager_rollback(table.pager)
+		result = EXECUTE_DATABASE_LOCKED
+	}
+	pager_unlock(table.pager)
+	return result
+}
+
+func execute_begin(table *Table) ExecuteResult {
+	if table.inTransaction {
+		return EXECUTE_TRANSACTION_ACTIVE
+	}
+	table.inTransaction = true
+	return EXECUTE_SUCCESS
+}
+
+func execute_commit(table *Table) ExecuteResult {
+	if !table.inTransaction {
+		return EXECUTE_NO_TRANSACTION
+	}
+	/* The transaction stays open, so the commit can be retried or rolled back */
+	if !pager_commit(table.pager) {
+		return EXECUTE_DATABASE_LOCKED
+	}
+	table.inTransaction = false
+	return EXECUTE_SUCCESS
+}
+
+func execute_rollback(table *Table) ExecuteResult {
+	if !table.inTransaction {
+		return EXECUTE_NO_TRANSACTION
+	}
+	pager_rollback(table.pager)
+	table.rootPageNum = header_root_page(get_page(table.pager, HEADER_PAGE_NUM))
+	table.inTransaction = false
+	return EXECUTE_SUCCESS
+}
+
+func execute_savepoint(statement *Statement, table *Table) ExecuteResult {
+	if !table.inTransaction {
+		return EXECUTE_NO_TRANSACTION
+	}
+	pager_savepoint(table.pager, statement.savepointName)
+	return EXECUTE_SUCCESS
+}
+
+/*
+ * Forget a savepoint and every savepoint started after it, keeping their changes
+ */
+func execute_release(statement *Statement, table *Table) ExecuteResult {
+	index := pager_find_savepoint(table.pager, statement.savepointName)
+	if index < 0 {
+		return EXECUTE_NO_SUCH_SAVEPOINT
+	}
+	pager_release(table.pager, index)
+	return EXECUTE_SUCCESS
+}
+
+/*
+ * Undo the changes made since a savepoint was started. The savepoint stays
+ * active, the savepoints started after it are forgotten.
+ */
+func execute_rollback_to(statement *Statement, table *Table) ExecuteResult {
+	index := pager_find_savepoint(table.pager, statement.savepointName)
+	if index < 0 {
+		return EXECUTE_NO_SUCH_SAVEPOINT
+	}
+	pager_rollback_to(table.pager, index)
+	table.rootPageNum = header_root_page(get_page(table.pager, HEADER_PAGE_NUM))
+	return EXECUTE_SUCCESS
+}
+
+/*
+ * The key of a row is stored in its cell, the payload holds the
+ * username and the email, each prefixed with its length as a uvarint
+ */
+func serialize_row(src *Row) []byte {
+	dst := make([]byte, 0, 2*binary.MaxVarintLen64+len(src.username)+len(src.email))
+	dst = append_length_prefixed(dst, src.username)
+	dst = append_length_prefixed(dst, src.email)
+	return dst
+}
+
+func deserialize_row(key []byte, src []byte) Row {
+	var dst Row
+	dst.key = key
+	rest := src
+	dst.username, rest = read_length_prefixed(rest)
+	dst.email, _ = read_length_prefixed(rest)
+	return dst
+}
+
+var KEY_TYPE_NAMES = map[KeyType]string{
+	KEY_TYPE_INT64: "int64",
+	KEY_TYPE_TEXT:  "text",
+	KEY_TYPE_BLOB:  "blob",
+}
+
+/*
+ * Parse a key type given on the command line, composite key types
+ * list the type of each component separated by commas
+ */
+func parse_key_types(name string) ([]KeyType, bool) {
+	names := strings.Split(name, ",")
+	if len(names) > HEADER_KEY_TYPES_SIZE {
+		return nil, false
+	}
+	keyTypes := make([]KeyType, 0, len(names))
+	for _, componentName := range names {
+		found := false
+		for keyType, typeName := range KEY_TYPE_NAMES {
+			if typeName == componentName {
+				keyTypes = append(keyTypes, keyType)
+				found = true
 			}
 		}
+		if !found {
+			return nil, false
+		}
+	}
+	return keyTypes, true
+}
 
-		if pagenum >= pager.numPages {
-			pager.numPages = pagenum + 1
+func key_types_name(keyTypes []KeyType) string {
+	names := make([]string, len(keyTypes))
+	for i, keyType := range keyTypes {
+		names[i] = KEY_TYPE_NAMES[keyType]
+	}
+	return strings.Join(names, ",")
+}
+
+/*
+ * Encode a key written in a statement. The components of a composite
+ * key are separated by commas, blob values are written in hex.
+ */
+func encode_key(keyTypes []KeyType, literal string) ([]byte, bool) {
+	values := []string{literal}
+	if len(keyTypes) > 1 {
+		values = strings.Split(literal, ",")
+		if len(values) != len(keyTypes) {
+			return nil, false
 		}
 	}
 
-	return pager.pages[pagenum]
+	key := []byte{}
+	for i, keyType := range keyTypes {
+		key = append(key, byte(keyType))
+		switch keyType {
+		case KEY_TYPE_INT64:
+			value, err := strconv.ParseInt(values[i], 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			key = binary.LittleEndian.AppendUint64(key, uint64(value))
+		case KEY_TYPE_TEXT:
+			key = append_length_prefixed(key, values[i])
+		case KEY_TYPE_BLOB:
+			value, err := hex.DecodeString(values[i])
+			if err != nil {
+				return nil, false
+			}
+			key = append_length_prefixed(key, string(value))
+		}
+	}
+	return key, true
 }
 
-func get_unused_page_num(pager *Pager) uint32 {
-	return pager.numPages
+/*
+ * Split the first component off an encoded key.
+ * Return its type, its value and the remaining components.
+ */
+func key_component(key []byte) (KeyType, []byte, []byte) {
+	keyType := KeyType(key[0])
+	rest := key[KEY_TAG_SIZE:]
+	if keyType == KEY_TYPE_INT64 {
+		return keyType, rest[:KEY_INT64_SIZE], rest[KEY_INT64_SIZE:]
+	}
+	length, n := binary.Uvarint(rest)
+	end := n + int(length)
+	return keyType, rest[n:end], rest[end:]
 }
 
-func pager_flush(pager *Pager, pagenum uint32) {
-	if pager.pages[pagenum] == nil {
-		fmt.Printf("Tried to flush null page.\n")
-		os.Exit(1)
+/*
+ * Return whether the key is a well formed key of the given type
+ */
+func key_is_valid(keyTypes []KeyType, key []byte) bool {
+	for _, keyType := range keyTypes {
+		if len(key) < KEY_TAG_SIZE || KeyType(key[0]) != keyType {
+			return false
+		}
+		rest := key[KEY_TAG_SIZE:]
+		if keyType == KEY_TYPE_INT64 {
+			if len(rest) < KEY_INT64_SIZE {
+				return false
+			}
+			key = rest[KEY_INT64_SIZE:]
+			continue
+		}
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || length > uint64(len(rest)-n) {
+			return false
+		}
+		key = rest[n+int(length):]
 	}
+	return len(key) == 0
+}
 
-	_, err := pager.fileDescriptor.Seek(int64(pagenum*PAGE_SIZE), 0)
-	if err != nil {
-		fmt.Printf("Error seeking. %v\n", err)
-		os.Exit(1)
+func format_key(key []byte) string {
+	values := []string{}
+	for len(key) > 0 {
+		keyType, value, rest := key_component(key)
+		switch keyType {
+		case KEY_TYPE_INT64:
+			values = append(values, strconv.FormatInt(int64(binary.LittleEndian.Uint64(value)), 10))
+		case KEY_TYPE_TEXT:
+			values = append(values, string(value))
+		case KEY_TYPE_BLOB:
+			values = append(values, hex.EncodeToString(value))
+		}
+		key = rest
 	}
+	return strings.Join(values, ",")
+}
 
-	_, err = pager.fileDescriptor.Write(pager.pages[pagenum][0:PAGE_SIZE])
-	if err != nil {
+func compare_int64_keys(a []byte, b []byte) int {
+	x := int64(binary.LittleEndian.Uint64(a[KEY_TAG_SIZE:]))
+	y := int64(binary.LittleEndian.Uint64(b[KEY_TAG_SIZE:]))
+	return cmp.Compare(x, y)
+}
+
+/*
+ * Text and blob keys compare byte by byte, a prefix sorts first
+ */
+func compare_bytes_keys(a []byte, b []byte) int {
+	_, x, _ := key_component(a)
+	_, y, _ := key_component(b)
+	return bytes.Compare(x, y)
+}
+
+/*
+ * Composite keys compare component by component
+ */
+func compare_composite_keys(a []byte, b []byte) int {
+	for len(a) > 0 && len(b) > 0 {
+		keyType, x, restA := key_component(a)
+		_, y, restB := key_component(b)
+		var result int
+		if keyType == KEY_TYPE_INT64 {
+			result = cmp.Compare(int64(binary.LittleEndian.Uint64(x)), int64(binary.LittleEndian.Uint64(y)))
+		} else {
+			result = bytes.Compare(x, y)
+		}
+		if result != 0 {
+			return result
+		}
+		a, b = restA, restB
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+/*
+ * Return the comparator for keys of the given type
+ */
+func key_comparator(keyTypes []KeyType) KeyComparator {
+	if len(keyTypes) > 1 {
+		return compare_composite_keys
+	}
+	if keyTypes[0] == KEY_TYPE_INT64 {
+		return compare_int64_keys
+	}
+	return compare_bytes_keys
+}
+
+func print_row(row *Row) {
+	fmt.Printf("{%s %s %s}\n", format_key(row.key), row.username, row.email)
+}
+
+func append_length_prefixed(dst []byte, value string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(value)))
+	return append(dst, value...)
+}
+
+func read_length_prefixed(src []byte) (string, []byte) {
+	length, n := binary.Uvarint(src)
+	end := n + int(length)
+	return string(src[n:end]), src[end:]
+}
+
+func cursor_key(cursor *Cursor) []byte {
+	page := get_page(cursor.table.pager, cursor.pageNum)
+	return append([]byte(nil), leaf_node_cell_key(page, cursor.cellNum)...)
+}
+
+func cursor_value(cursor *Cursor) []byte {
+	pagenum := cursor.pageNum
+	page := get_page(cursor.table.pager, pagenum)
+	return leaf_cell_payload(cursor.table.pager, leaf_node_cell(page, cursor.cellNum))
+}
+
+func execute_insert(statement *Statement, table *Table) ExecuteResult {
+	keyToInsert := statement.rowToInsert.key
+	cursor := table_find(table, keyToInsert)
+
+	node := get_page(table.pager, cursor.pageNum)
+	numCells := leaf_node_num_cells(node)
+
+	if cursor.cellNum < numCells {
+		// check whether the key exists
+		keyAtIndex := leaf_node_cell_key(node, cursor.cellNum)
+		if table.compareKeys(keyAtIndex, keyToInsert) == 0 {
+			cursor_close(cursor)
+			return EXECUTE_DUPLICATE_KEY
+		}
+	}
+	leaf_node_insert(cursor, keyToInsert, statement.rowToInsert)
+	cursor_close(cursor)
+	return EXECUTE_SUCCESS
+}
+
+func execute_select(statement *Statement, table *Table) ExecuteResult {
+	keyRange := &statement.keyRange
+	var cursor *Cursor
+	if statement.descending {
+		if keyRange.upper != nil {
+			cursor = table_seek_last(table, keyRange.upper, keyRange.upperInclusive)
+		} else {
+			cursor = table_end(table)
+		}
+		if keyRange.lower != nil {
+			cursor_set_lower_bound(cursor, keyRange.lower, keyRange.lowerInclusive)
+		}
+	} else {
+		if keyRange.lower != nil {
+			cursor = table_seek(table, keyRange.lower, keyRange.lowerInclusive)
+		} else {
+			cursor = table_start(table)
+		}
+		if keyRange.upper != nil {
+			cursor_set_upper_bound(cursor, keyRange.upper, keyRange.upperInclusive)
+		}
+	}
+
+	for numRows := int64(0); !cursor.endOfTable && numRows != statement.limit; numRows++ {
+		row := deserialize_row(cursor_key(cursor), cursor_value(cursor))
+		print_row(&row)
+		if statement.descending {
+			cursor_retreat(cursor)
+		} else {
+			cursor_advance(cursor)
+		}
+	}
+	cursor_close(cursor)
+	return EXECUTE_SUCCESS
+}
+
+func execute_delete(statement *Statement, table *Table) ExecuteResult {
+	keyToDelete := statement.keyToDelete
+	cursor := table_find(table, keyToDelete)
+
+	node := get_page(table.pager, cursor.pageNum)
+	if cursor.cellNum >= leaf_node_num_cells(node) || table.compareKeys(leaf_node_cell_key(node, cursor.cellNum), keyToDelete) != 0 {
+		cursor_close(cursor)
+		return EXECUTE_KEY_NOT_FOUND
+	}
+	leaf_node_delete(cursor)
+	cursor_close(cursor)
+	return EXECUTE_SUCCESS
+}
+
+func execute_update(statement *Statement, table *Table) ExecuteResult {
+	/*
+		Collect the keys of the matching rows first, updating rows
+		while scanning would move cells under the cursor.
+	*/
+	var keys [][]byte
+	predicate := statement.predicate
+	if predicate != nil && predicate.column == COLUMN_ID {
+		cursor := table_find(table, predicate.key)
+		node := get_page(table.pager, cursor.pageNum)
+		if cursor.cellNum < leaf_node_num_cells(node) && table.compareKeys(leaf_node_cell_key(node, cursor.cellNum), predicate.key) == 0 {
+			keys = append(keys, predicate.key)
+		}
+		cursor_close(cursor)
+	} else {
+		cursor := table_start(table)
+		for !cursor.endOfTable {
+			row := deserialize_row(cursor_key(cursor), cursor_value(cursor))
+			if row_matches(&row, predicate) {
+				keys = append(keys, row.key)
+			}
+			cursor_advance(cursor)
+		}
+		cursor_close(cursor)
+	}
+
+	/* Every row would end up with the same new key */
+	newKey := update_new_key(statement)
+	if newKey != nil && len(keys) > 1 {
+		return EXECUTE_DUPLICATE_KEY
+	}
+	if newKey != nil && len(keys) == 1 && table.compareKeys(newKey, keys[0]) != 0 {
+		cursor := table_find(table, newKey)
+		node := get_page(table.pager, cursor.pageNum)
+		exists := cursor.cellNum < leaf_node_num_cells(node) && table.compareKeys(leaf_node_cell_key(node, cursor.cellNum), newKey) == 0
+		cursor_close(cursor)
+		if exists {
+			return EXECUTE_DUPLICATE_KEY
+		}
+	}
+
+	for _, key := range keys {
+		update_row(statement, table, key)
+	}
+	fmt.Printf("Updated %d rows.\n", len(keys))
+	return EXECUTE_SUCCESS
+}
+
+/*
+ * Rebuild the table into a new file with packed leaves and consecutive
+ * page numbers, then rename it over the database file
+ */
+func execute_vacuum(table *Table) ExecuteResult {
+	if table.inTransaction {
+		return EXECUTE_TRANSACTION_ACTIVE
+	}
+	pager := table.pager
+	fileName := pager.fileName
+	vacuumFileName := fileName + "-vacuum"
+	/* The old file and its journal go away, so its changes must be committed first */
+	if !pager_commit(pager) || !pager_lock(pager, LOCK_EXCLUSIVE) {
+		return EXECUTE_DATABASE_LOCKED
+	}
+	if pager.walFile != nil {
+		pager_checkpoint(pager)
+	}
+	oldSize := int64(pager.numPages) * int64(PAGE_SIZE)
+
+	options := Options{}
+	options.cacheSize = pager.cacheSize
+	options.pageSize = PAGE_SIZE
+	options.keyTypes = table.keyTypes
+	options.busyTimeout = uint32(pager.busyTimeout / time.Millisecond)
+	options.synchronous = pager.synchronous
+	os.Remove(vacuumFileName)
+	os.Remove(vacuumFileName + JOURNAL_SUFFIX)
+	os.Remove(vacuumFileName + WAL_SUFFIX)
+	newTable := db_open(vacuumFileName, &options)
+	if !pager_lock(newTable.pager, LOCK_EXCLUSIVE) {
+		pager_close(newTable.pager)
+		return EXECUTE_DATABASE_LOCKED
+	}
+	defer discard_vacuum_on_corruption(newTable, vacuumFileName)
+
+	header := get_page(pager, HEADER_PAGE_NUM)
+	newHeader := get_page(newTable.pager, HEADER_PAGE_NUM)
+	pager_mark_dirty(newTable.pager, HEADER_PAGE_NUM)
+	set_header_schema_cookie(newHeader, header_schema_cookie(header))
+
+	cursor := table_start(table)
+	next := func() *Row {
+		if cursor.endOfTable {
+			return nil
+		}
+		row := deserialize_row(cursor_key(cursor), cursor_value(cursor))
+		cursor_advance(cursor)
+		return &row
+	}
+	result := bulk_load(newTable, next, MAX_FILL_FACTOR)
+	cursor_close(cursor)
+	if result != EXECUTE_SUCCESS {
+		discard_vacuum_file(newTable, vacuumFileName)
+		return result
+	}
+	newSize := int64(newTable.pager.numPages) * int64(PAGE_SIZE)
+
+	/*
+	 * The new file must be complete on disk before it replaces the old one.
+	 * Both stay locked until then; other processes notice the new file the
+	 * next time they lock it.
+	 */
+	if !pager_commit(newTable.pager) {
+		discard_vacuum_file(newTable, vacuumFileName)
+		return EXECUTE_DATABASE_LOCKED
+	}
+	if err := os.Rename(vacuumFileName, fileName); err != nil {
+		fmt.Printf("Error replacing database file. %v\n", err)
+		discard_vacuum_file(newTable, vacuumFileName)
+		return EXECUTE_FAILURE
+	}
+	if pager.synchronous >= SYNCHRONOUS_FULL {
+		sync_directory(fileName)
+	}
+	newTable.pager.fileName = fileName
+	/* The checkpointed log goes on with the new file */
+	if pager.walFile != nil {
+		newPager := newTable.pager
+		newPager.journalMode = JOURNAL_MODE_WAL
+		newPager.walFile = pager.walFile
+		newPager.walIndex = pager.walIndex
+		newPager.walPending = pager.walPending
+		newPager.walNumFrames = 0
+		newPager.walNumPages = newPager.numPages
+		newPager.walCheckpoints = pager.walCheckpoints
+		pager_lock_mode(newPager)
+		pager.walFile = nil
+	}
+	pager_close(pager)
+	*table = *newTable
+	fmt.Printf("Reclaimed %d bytes.\n", oldSize-newSize)
+	return EXECUTE_SUCCESS
+}
+
+/*
+ * Return the key assigned by the update, nil when the key is not changed
+ */
+/*
+ * Remove the vacuum file when a page of the database failed its checksum
+ * while it was copied, and go on abandoning the command
+ */
+func discard_vacuum_on_corruption(newTable *Table, vacuumFileName string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	discard_vacuum_file(newTable, vacuumFileName)
+	panic(r)
+}
+
+/*
+ * Close a vacuum file that did not replace the database and remove it
+ */
+func discard_vacuum_file(newTable *Table, vacuumFileName string) {
+	if newTable.pager.journalFile != nil {
+		newTable.pager.journalFile.Close()
+	}
+	pager_close(newTable.pager)
+	os.Remove(vacuumFileName)
+	os.Remove(vacuumFileName + JOURNAL_SUFFIX)
+}
+
+func update_new_key(statement *Statement) []byte {
+	var key []byte
+	for _, assignment := range statement.assignments {
+		if assignment.column == COLUMN_ID {
+			key = assignment.key
+		}
+	}
+	return key
+}
+
+func row_matches(row *Row, predicate *Predicate) bool {
+	if predicate == nil {
+		return true
+	}
+	switch predicate.column {
+	case COLUMN_USERNAME:
+		return row.username == predicate.value
+	case COLUMN_EMAIL:
+		return row.email == predicate.value
+	}
+	return bytes.Equal(row.key, predicate.key)
+}
+
+/*
+ * Apply the assignments to the row with the given key. A row keeping its
+ * key is rewritten in its leaf when the new cell fits there, otherwise
+ * the old cell is deleted and the row inserted again at its new position.
+ */
+func update_row(statement *Statement, table *Table, key []byte) {
+	cursor := table_find(table, key)
+	row := deserialize_row(cursor_key(cursor), cursor_value(cursor))
+	for _, assignment := range statement.assignments {
+		switch assignment.column {
+		case COLUMN_ID:
+			row.key = assignment.key
+		case COLUMN_USERNAME:
+			row.username = assignment.value
+		case COLUMN_EMAIL:
+			row.email = assignment.value
+		}
+	}
+
+	pager := table.pager
+	node := get_page(pager, cursor.pageNum)
+	oldCell := leaf_node_cell(node, cursor.cellNum)
+	payload := serialize_row(&row)
+	newCellSize := leaf_cell_size(uint32(len(row.key)), uint32(len(payload)))
+	if table.compareKeys(row.key, key) == 0 && newCellSize <= leaf_node_free_space(node)+uint32(len(oldCell)) {
+		pager_mark_dirty(pager, cursor.pageNum)
+		free_overflow_chain(pager, oldCell)
+		leaf_node_remove_cell(node, cursor.cellNum)
+		cell := leaf_node_build_cell(pager, row.key, payload)
+		node = get_page(pager, cursor.pageNum)
+		leaf_node_insert_cell(node, cursor.cellNum, cell)
+		/* A smaller cell may leave the leaf underfull */
+		btree_rebalance(table, cursor.pageNum)
+		cursor_close(cursor)
+		return
+	}
+
+	leaf_node_delete(cursor)
+	cursor_close(cursor)
+	cursor = table_find(table, row.key)
+	leaf_node_insert(cursor, row.key, &row)
+	cursor_close(cursor)
+}
+
+/*
+ * Build the tree of an empty table bottom-up from rows sorted by key.
+ * Leaves are filled to fillFactor percent and written one after the
+ * other, then the internal levels are built on top of them. A load that
+ * fails leaves the pages written so far to be rolled back by the caller.
+ */
+func bulk_load(table *Table, next RowIterator, fillFactor uint32) ExecuteResult {
+	loader, result := bulk_load_begin(table, fillFactor)
+	if result != EXECUTE_SUCCESS {
+		return result
+	}
+	for row := next(); row != nil; row = next() {
+		if result := bulk_load_add(loader, row); result != EXECUTE_SUCCESS {
+			return result
+		}
+	}
+	bulk_load_finish(loader)
+	return EXECUTE_SUCCESS
+}
+
+func table_is_empty(table *Table) bool {
+	root := get_page(table.pager, table.rootPageNum)
+	return get_node_type(root) == NODE_LEAF && leaf_node_num_cells(root) == 0
+}
+
+func bulk_load_begin(table *Table, fillFactor uint32) (*BulkLoader, ExecuteResult) {
+	if !table_is_empty(table) {
+		return nil, EXECUTE_TABLE_NOT_EMPTY
+	}
+	loader := &BulkLoader{}
+	loader.table = table
+	loader.fillFactor = fillFactor
+	return loader, EXECUTE_SUCCESS
+}
+
+/*
+ * Append a row, whose key must sort after the key of the previous row
+ */
+func bulk_load_add(loader *BulkLoader, row *Row) ExecuteResult {
+	table := loader.table
+	if loader.lastKey != nil {
+		order := table.compareKeys(loader.lastKey, row.key)
+		if order == 0 {
+			return EXECUTE_DUPLICATE_KEY
+		}
+		if order > 0 {
+			return EXECUTE_KEY_OUT_OF_ORDER
+		}
+	}
+	loader.lastKey = row.key
+
+	cell := leaf_node_build_cell(table.pager, row.key, serialize_row(row))
+	cellSpace := uint32(len(cell)) + LEAF_NODE_CELL_POINTER_SIZE
+	if len(loader.cells) > 0 && loader.usedSpace+cellSpace > LEAF_NODE_SPACE_FOR_CELLS*loader.fillFactor/100 {
+		bulk_load_write_leaf(loader)
+	}
+	loader.cells = append(loader.cells, cell)
+	loader.usedSpace += cellSpace
+	return EXECUTE_SUCCESS
+}
+
+/*
+ * Write the cells collected so far to a new leaf linked after the previous one
+ */
+func bulk_load_write_leaf(loader *BulkLoader) {
+	pager := loader.table.pager
+	pageNum := get_unused_page_num(pager)
+	node := get_page(pager, pageNum)
+	pager_mark_dirty(pager, pageNum)
+	initialize_leaf_node(node)
+	leaf_node_set_cells(node, loader.cells)
+
+	if len(loader.leaves) > 0 {
+		previousPageNum := loader.leaves[len(loader.leaves)-1]
+		previous := get_page(pager, previousPageNum)
+		pager_mark_dirty(pager, previousPageNum)
+		set_leaf_node_next_leaf(previous, pageNum)
+	}
+	lastCell := loader.cells[len(loader.cells)-1]
+	loader.leaves = append(loader.leaves, pageNum)
+	loader.maxKeys = append(loader.maxKeys, append([]byte(nil), leaf_cell_key(lastCell)...))
+	loader.cells = nil
+	loader.usedSpace = 0
+
+	/* Leaves are not revisited until the internal levels are built */
+	pager_trim_cache(pager)
+}
+
+func bulk_load_finish(loader *BulkLoader) {
+	table := loader.table
+	pager := table.pager
+	root := get_page(pager, table.rootPageNum)
+
+	/* Everything fits in the root leaf */
+	if len(loader.leaves) == 0 {
+		pager_mark_dirty(pager, table.rootPageNum)
+		leaf_node_set_cells(root, loader.cells)
+		return
+	}
+	if len(loader.cells) > 0 {
+		bulk_load_write_leaf(loader)
+	}
+
+	/*
+		Group the nodes of each level under new internal nodes until
+		the root can hold the remaining ones. Spreading the nodes evenly
+		gives every internal node at least two children.
+	*/
+	children := loader.leaves
+	maxKeys := loader.maxKeys
+	maxChildren := int(INTERNAL_NODE_MAX_CELLS) + 1
+	for len(children) > maxChildren {
+		numNodes := (len(children) + maxChildren - 1) / maxChildren
+		var parents []uint32
+		var parentMaxKeys [][]byte
+		start := 0
+		for i := 0; i < numNodes; i++ {
+			end := start + (len(children)-start)/(numNodes-i)
+			pageNum := get_unused_page_num(pager)
+			node := get_page(pager, pageNum)
+			pager_mark_dirty(pager, pageNum)
+			initialize_internal_node(node)
+			internal_node_fill(pager, node, pageNum, children[start:end], maxKeys[start:end])
+			parents = append(parents, pageNum)
+			parentMaxKeys = append(parentMaxKeys, maxKeys[end-1])
+			start = end
+			pager_trim_cache(pager)
+		}
+		children = parents
+		maxKeys = parentMaxKeys
+	}
+
+	root = get_page(pager, table.rootPageNum)
+	pager_mark_dirty(pager, table.rootPageNum)
+	initialize_internal_node(root)
+	set_node_root(root, true)
+	internal_node_fill(pager, root, table.rootPageNum, children, maxKeys)
+
+	/* The last leaf takes whatever rows were left and may be too small */
+	lastLeafPageNum := loader.leaves[len(loader.leaves)-1]
+	if node_is_underflow(get_page(pager, lastLeafPageNum)) {
+		btree_rebalance(table, lastLeafPageNum)
+	}
+}
+
+/*
+ * Handle .load FILE [FILL_FACTOR]. The file holds one row per line,
+ * the key, username and email separated by spaces.
+ */
+func load_command(table *Table, args []string) {
+	fillFactor := uint64(DEFAULT_FILL_FACTOR)
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Printf("Usage: .load FILE [FILL_FACTOR]\n")
+		return
+	}
+	if len(args) == 2 {
+		var err error
+		fillFactor, err = strconv.ParseUint(args[1], 10, 32)
+		if err != nil || fillFactor < MIN_FILL_FACTOR || fillFactor > MAX_FILL_FACTOR {
+			fmt.Printf("Fill factor must be between %d and %d.\n", MIN_FILL_FACTOR, MAX_FILL_FACTOR)
+			return
+		}
+	}
+
+	if !table_is_empty(table) {
+		fmt.Printf("Error: Table is not empty.\n")
+		return
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Printf("Unable to open %s.\n", args[0])
+		return
+	}
+	defer file.Close()
+
+	/* Validate every line first and find out whether the rows are sorted */
+	ok := true
+	numRows := uint32(0)
+	sorted := true
+	var lastKey []byte
+	rows := load_file_rows(table, file, &ok)
+	for row := rows(); row != nil; row = rows() {
+		if lastKey != nil && table.compareKeys(lastKey, row.key) >= 0 {
+			sorted = false
+		}
+		lastKey = row.key
+		numRows++
+	}
+	if !ok {
+		return
+	}
+
+	file.Seek(0, io.SeekStart)
+	next := load_file_rows(table, file, &ok)
+	if !sorted {
+		runs, written := write_sort_runs(table, next)
+		if !written {
+			return
+		}
+		defer close_sort_runs(runs)
+		if !ok {
+			return
+		}
+		next = merge_sort_runs(table, runs, &ok)
+	}
+
+	/* A load that fails is undone on its own, the transaction it is part of goes on */
+	pager := table.pager
+	pager_savepoint(pager, "")
+	savepoint := len(pager.savepoints) - 1
+	result := bulk_load(table, next, uint32(fillFactor))
+	if result == EXECUTE_SUCCESS && !ok {
+		result = EXECUTE_FAILURE
+	}
+	if result != EXECUTE_SUCCESS {
+		pager_rollback_to(pager, savepoint)
+		table.rootPageNum = header_root_page(get_page(pager, HEADER_PAGE_NUM))
+	}
+	pager_release(pager, savepoint)
+
+	switch result {
+	case EXECUTE_SUCCESS:
+		fmt.Printf("Loaded %d rows.\n", numRows)
+	case EXECUTE_DUPLICATE_KEY:
+		fmt.Printf("Error: Duplicate key.\n")
+	case EXECUTE_KEY_OUT_OF_ORDER:
+		fmt.Printf("Error: Keys are out of order.\n")
+	case EXECUTE_TABLE_NOT_EMPTY:
+		fmt.Printf("Error: Table is not empty.\n")
+	}
+}
+
+/*
+ * Return an iterator over the rows of a load file, skipping blank lines.
+ * The first invalid line is reported, clears ok and ends the iteration.
+ */
+func load_file_rows(table *Table, file *os.File, ok *bool) RowIterator {
+	reader := bufio.NewReader(file)
+	lineNum := 0
+	return func() *Row {
+		for *ok {
+			line, err := reader.ReadString('\n')
+			if line == "" && err != nil {
+				return nil
+			}
+			lineNum++
+			line = strings.TrimRight(line, "\r\n")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			row := &Row{}
+			switch prepare_row(table, line, row) {
+			case PREPARE_STATEMENT_SUCCESS:
+				return row
+			case PREPARE_KEY_TOO_LONG:
+				fmt.Printf("Key is too long on line %d.\n", lineNum)
+			default:
+				fmt.Printf("Syntax error on line %d.\n", lineNum)
+			}
+			*ok = false
+		}
+		return nil
+	}
+}
+
+/*
+ * Split the rows into runs of LOAD_SORT_RUN_SIZE rows, sort each run
+ * in memory and write it to a temporary file. Return false, with the
+ * runs written so far closed, when a temporary file can not be written.
+ */
+func write_sort_runs(table *Table, next RowIterator) ([]*SortRun, bool) {
+	var runs []*SortRun
+	rows := make([]*Row, 0, LOAD_SORT_RUN_SIZE)
+	for row := next(); row != nil || len(rows) > 0; row = next() {
+		if row != nil {
+			rows = append(rows, row)
+			if len(rows) < LOAD_SORT_RUN_SIZE {
+				continue
+			}
+		}
+		slices.SortFunc(rows, func(a *Row, b *Row) int {
+			return table.compareKeys(a.key, b.key)
+		})
+		run := write_sort_run(rows)
+		if run == nil {
+			close_sort_runs(runs)
+			return nil, false
+		}
+		runs = append(runs, run)
+		rows = rows[:0]
+		if row == nil {
+			break
+		}
+	}
+	return runs, true
+}
+
+/*
+ * Write sorted rows to a temporary file, which is removed as soon as it
+ * is created so it goes away when closed. Return nil on failure.
+ */
+func write_sort_run(rows []*Row) *SortRun {
+	file, err := os.CreateTemp("", "sort-run-")
+	if err != nil {
+		fmt.Printf("Unable to create temporary file. %v\n", err)
+		return nil
+	}
+	os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	for _, row := range rows {
+		record := append_length_prefixed(nil, string(row.key))
+		record = append_length_prefixed(record, string(serialize_row(row)))
+		writer.Write(record)
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Printf("Error writing temporary file. %v\n", err)
+		file.Close()
+		return nil
+	}
+	file.Seek(0, io.SeekStart)
+
+	run := &SortRun{}
+	run.file = file
+	run.reader = bufio.NewReader(file)
+	return run
+}
+
+/*
+ * Move the run to its next row, setting row to nil at the end of the
+ * file. Return false when the file can not be read.
+ */
+func sort_run_advance(run *SortRun) bool {
+	run.row = nil
+	key, ok := read_sort_run_field(run.reader)
+	if !ok {
+		return true
+	}
+	payload, ok := read_sort_run_field(run.reader)
+	if !ok {
+		fmt.Printf("Error reading temporary file.\n")
+		return false
+	}
+	row := deserialize_row(key, payload)
+	run.row = &row
+	return true
+}
+
+func read_sort_run_field(reader *bufio.Reader) ([]byte, bool) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, false
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(reader, field); err != nil {
+		return nil, false
+	}
+	return field, true
+}
+
+/*
+ * Return an iterator over the rows of all runs in key order. A run that
+ * can not be read clears ok and ends the iteration.
+ */
+func merge_sort_runs(table *Table, runs []*SortRun, ok *bool) RowIterator {
+	runHeap := &SortRunHeap{compareKeys: table.compareKeys}
+	for _, run := range runs {
+		if !sort_run_advance(run) {
+			*ok = false
+		}
+		if run.row != nil {
+			runHeap.runs = append(runHeap.runs, run)
+		}
+	}
+	heap.Init(runHeap)
+
+	return func() *Row {
+		if !*ok || runHeap.Len() == 0 {
+			return nil
+		}
+		run := runHeap.runs[0]
+		row := run.row
+		if !sort_run_advance(run) {
+			*ok = false
+			return nil
+		}
+		if run.row == nil {
+			heap.Pop(runHeap)
+		} else {
+			heap.Fix(runHeap, 0)
+		}
+		return row
+	}
+}
+
+func close_sort_runs(runs []*SortRun) {
+	for _, run := range runs {
+		run.file.Close()
+	}
+}
+
+func (h *SortRunHeap) Len() int { return len(h.runs) }
+
+func (h *SortRunHeap) Less(i, j int) bool {
+	return h.compareKeys(h.runs[i].row.key, h.runs[j].row.key) < 0
+}
+
+func (h *SortRunHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *SortRunHeap) Push(x any) { h.runs = append(h.runs, x.(*SortRun)) }
+
+func (h *SortRunHeap) Pop() any {
+	run := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return run
+}
+
+func db_open(filename string, options *Options) *Table {
+	defer exit_on_page_corruption()
+	pager := pager_open(filename, options)
+	table := new(Table)
+	table.pager = pager
+	if pager.numPages == 0 {
+		// New database file. Initial page 0 as header and page 1 as leaf node
+		header := get_page(pager, HEADER_PAGE_NUM)
+		pager_mark_dirty(pager, HEADER_PAGE_NUM)
+		initialize_header(header, options)
+		rootNode := get_page(pager, ROOT_PAGE_NUM)
+		pager_mark_dirty(pager, ROOT_PAGE_NUM)
+		initialize_leaf_node(rootNode)
+		set_node_root(rootNode, true)
+		pager_commit(pager)
+	}
+	/* A new database is written to the file, so other processes can tell it exists */
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		wal_open(pager)
+	}
+
+	header := get_page(pager, HEADER_PAGE_NUM)
+	table.rootPageNum = header_root_page(header)
+	if table.rootPageNum == HEADER_PAGE_NUM || table.rootPageNum >= pager.numPages {
+		fmt.Printf("Database root page %d is out of bounds.\n", table.rootPageNum)
+		os.Exit(1)
+	}
+	table.keyTypes = read_key_types(header)
+	table.compareKeys = key_comparator(table.keyTypes)
+	pager_unlock(pager)
+	return table
+}
+
+/*
+ * A database whose header page fails its checksum can not be opened
+ */
+func exit_on_page_corruption() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	corruption, ok := r.(PageCorruption)
+	if !ok {
+		panic(r)
+	}
+	fmt.Printf("Checksum mismatch on page %d.\n", corruption.pageNum)
+	os.Exit(1)
+}
+
+func initialize_header(header []byte, options *Options) {
+	copy(header_magic(header), HEADER_MAGIC)
+	set_header_format_version(header, FORMAT_VERSION)
+	set_header_page_size(header, PAGE_SIZE)
+	set_header_root_page(header, ROOT_PAGE_NUM)
+	set_freelist_trunk_page(header, 0)
+	set_freelist_page_count(header, 0)
+	set_header_page_count(header, 0)
+	set_header_schema_cookie(header, 0)
+	set_header_change_counter(header, 0)
+	keyTypes := header_key_types(header)
+	for i := range keyTypes {
+		keyTypes[i] = byte(KEY_TYPE_NONE)
+	}
+	for i, keyType := range options.keyTypes {
+		keyTypes[i] = byte(keyType)
+	}
+}
+
+/*
+ * Refuse files that were not written by this program, or by a version
+ * with an incompatible format, before any page of them is used.
+ */
+func validate_header(header []byte, fileLength int64) {
+	if string(header_magic(header)) != HEADER_MAGIC {
+		fmt.Printf("File is not a database.\n")
+		os.Exit(1)
+	}
+	if version := header_format_version(header); version != FORMAT_VERSION {
+		fmt.Printf("Unsupported database format version %d, expected %d.\n", version, FORMAT_VERSION)
+		os.Exit(1)
+	}
+	pageSize := int64(header_page_size(header))
+	if !is_valid_page_size(uint(pageSize)) {
+		fmt.Printf("Unsupported database page size %d.\n", pageSize)
+		os.Exit(1)
+	}
+	if fileLength%pageSize != 0 {
+		fmt.Printf("DB file is not a whole number of pages.\n")
+		os.Exit(1)
+	}
+	if pageCount := header_page_count(header); int64(pageCount) > fileLength/pageSize {
+		fmt.Printf("DB file is truncated: header records %d pages, file has %d.\n", pageCount, fileLength/pageSize)
+		os.Exit(1)
+	}
+	keyTypes := read_key_types(header)
+	if len(keyTypes) == 0 {
+		fmt.Printf("Unsupported database key type.\n")
+		os.Exit(1)
+	}
+	for _, keyType := range keyTypes {
+		if keyType > KEY_TYPE_BLOB {
+			fmt.Printf("Unsupported database key type.\n")
+			os.Exit(1)
+		}
+	}
+}
+
+func db_close(table *Table) {
+	pager := table.pager
+	/* A transaction that was never committed is abandoned */
+	if table.inTransaction {
+		pager_rollback(pager)
+	}
+	pager_commit(pager)
+	pager_unlock(pager)
+	/* The last process using the log copies it into the file and removes it */
+	if pager.walFile != nil && lock_range(pager.fileDescriptor, syscall.F_WRLCK, LOCK_WAL_BYTE, 1) && pager_lock(pager, LOCK_EXCLUSIVE) {
+		pager_checkpoint(pager)
+		os.Remove(pager.fileName + WAL_SUFFIX)
+	}
+	pager.pages = nil
+	pager.lru = nil
+
+	pager_close(pager)
+}
+
+func pager_open(filename string, options *Options) *Pager {
+	// Read the persistent file
+	fd, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		fmt.Printf("Unable to open file.\n")
+		os.Exit(1)
+	}
+	pager := new(Pager)
+	pager.fileName = filename
+	pager.fileDescriptor = fd
+	pager.pages = make(map[uint32]*CachedPage)
+	pager.lru = list.New()
+	pager.cacheSize = options.cacheSize
+	pager.journaledPages = make(map[uint32]bool)
+	pager.busyTimeout = time.Duration(options.busyTimeout) * time.Millisecond
+	pager.synchronous = options.synchronous
+	pager.journalMode = options.journalMode
+	if !pager_lock_mode(pager) {
+		fmt.Printf("Error: Database is open in another journal mode.\n")
+		os.Exit(1)
+	}
+	if !pager_lock(pager, LOCK_SHARED) {
+		fmt.Printf("Error: Database is locked.\n")
+		os.Exit(1)
+	}
+	/* Only one process may create the database */
+	if pager.fileLength == 0 {
+		pager_unlock(pager)
+		if !pager_lock(pager, LOCK_EXCLUSIVE) {
+			fmt.Printf("Error: Database is locked.\n")
+			os.Exit(1)
+		}
+	}
+
+	/* A vacuum in another process may have replaced the file while waiting */
+	fd = pager.fileDescriptor
+	offset, err := fd.Seek(0, 2)
+	if offset > 0 {
+		header := make([]byte, HEADER_SIZE)
+		if _, err := fd.ReadAt(header, 0); err != nil {
+			fmt.Printf("File is not a database.\n")
+			os.Exit(1)
+		}
+		validate_header(header, offset)
+		configure_page_layout(header_page_size(header))
+	} else {
+		configure_page_layout(options.pageSize)
+	}
+	// Init the pager based on the persistent file
+	pager.fileLength = offset
+	pager.numPages = uint32(offset / int64(PAGE_SIZE))
+
+	return pager
+}
+
+/*
+ * Hold the read lock on the byte of the pager's journal mode, waiting for
+ * the last process using the WAL to remove it. Return false when another
+ * process has the database open in the other mode.
+ */
+func pager_lock_mode(pager *Pager) bool {
+	fd := pager.fileDescriptor
+	modeByte, otherByte := int64(LOCK_ROLLBACK_BYTE), int64(LOCK_WAL_BYTE)
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		modeByte, otherByte = LOCK_WAL_BYTE, LOCK_ROLLBACK_BYTE
+	}
+	lock_range(fd, syscall.F_UNLCK, otherByte, 1)
+	wait_lock_range(fd, syscall.F_RDLCK, modeByte, 1)
+	return !range_is_locked(fd, otherByte, 1)
+}
+
+/*
+ * Raise the lock on the database file to level, going through the levels
+ * below it, and wait up to the busy timeout for other processes to let go.
+ * A reader waiting for the reserved lock would keep the writer holding it
+ * from ever committing, so it gives up at once if it was reading already,
+ * or lets go of its shared lock while it waits.
+ */
+func pager_lock(pager *Pager, level LockLevel) bool {
+	return pager_lock_until(pager, level, time.Now().Add(pager.busyTimeout))
+}
+
+func pager_lock_until(pager *Pager, level LockLevel, deadline time.Time) bool {
+	start := pager.lock
+	for pager.lock < level {
+		next := pager.lock + 1
+		if pager_try_lock(pager, next) {
+			pager.lock = next
+			/*
+			 * Readers do not keep a writer out of the log, so another process
+			 * may have committed since this one started reading. Writing on
+			 * top of the older pages would undo that commit.
+			 */
+			if next == LOCK_RESERVED && pager.walFile != nil && wal_begin_write(pager) && start >= LOCK_SHARED {
+				lock_range(pager.fileDescriptor, syscall.F_UNLCK, LOCK_RESERVED_BYTE, 1)
+				pager.lock = LOCK_SHARED
+				return false
+			}
+			continue
+		}
+		if next == LOCK_RESERVED && start >= LOCK_SHARED {
+			return false
+		}
+		if time.Now().After(deadline) {
+			if next == LOCK_EXCLUSIVE {
+				lock_range(pager.fileDescriptor, syscall.F_UNLCK, LOCK_PENDING_BYTE, 1)
+			}
+			return false
+		}
+		if next == LOCK_RESERVED {
+			pager_unlock(pager)
+		}
+		time.Sleep(LOCK_RETRY_INTERVAL)
+	}
+	return true
+}
+
+/*
+ * Try once to raise the lock by one level. A failed attempt at the
+ * exclusive lock keeps the pending byte, so the next attempt is not
+ * starved by new readers.
+ */
+func pager_try_lock(pager *Pager, level LockLevel) bool {
+	fd := pager.fileDescriptor
+	switch level {
+	case LOCK_SHARED:
+		return pager_try_lock_shared(pager)
+	case LOCK_RESERVED:
+		return lock_range(fd, syscall.F_WRLCK, LOCK_RESERVED_BYTE, 1)
+	case LOCK_EXCLUSIVE:
+		return lock_range(fd, syscall.F_WRLCK, LOCK_PENDING_BYTE, 1) &&
+			lock_range(fd, syscall.F_WRLCK, LOCK_SHARED_FIRST, LOCK_SHARED_SIZE)
+	}
+	return false
+}
+
+/*
+ * Take the shared lock on the file at the pager's path, recover what a
+ * crashed process left behind and drop the cache if another process
+ * committed since it was read
+ */
+func pager_try_lock_shared(pager *Pager) bool {
+	fd := pager.fileDescriptor
+	for {
+		/* A vacuum in another process replaces the file with a new one */
+		if !pager_is_current_file(pager) {
+			pager_reopen(pager)
+			fd = pager.fileDescriptor
+		}
+		if !lock_range(fd, syscall.F_RDLCK, LOCK_PENDING_BYTE, 1) {
+			return false
+		}
+		locked := lock_range(fd, syscall.F_RDLCK, LOCK_SHARED_FIRST, LOCK_SHARED_SIZE)
+		lock_range(fd, syscall.F_UNLCK, LOCK_PENDING_BYTE, 1)
+		if !locked {
+			return false
+		}
+		if pager_is_current_file(pager) {
+			break
+		}
+		lock_range(fd, syscall.F_UNLCK, LOCK_PENDING_BYTE, 2+LOCK_SHARED_SIZE)
+	}
+
+	if pager_has_hot_journal(pager) {
+		if !lock_range(fd, syscall.F_WRLCK, LOCK_RESERVED_BYTE, 1) || !pager_try_lock(pager, LOCK_EXCLUSIVE) {
+			lock_range(fd, syscall.F_UNLCK, LOCK_PENDING_BYTE, 2+LOCK_SHARED_SIZE)
+			return false
+		}
+		recover_hot_journal(fd, pager.fileName+JOURNAL_SUFFIX)
+		/* A process that started using the log meanwhile keeps it */
+		if pager.walFile == nil && lock_range(fd, syscall.F_WRLCK, LOCK_WAL_BYTE, 1) {
+			recover_wal(fd, pager.fileName+WAL_SUFFIX)
+			pager_lock_mode(pager)
+		}
+		lock_range(fd, syscall.F_RDLCK, LOCK_SHARED_FIRST, LOCK_SHARED_SIZE)
+		lock_range(fd, syscall.F_UNLCK, LOCK_PENDING_BYTE, 2)
+	}
+	pager_validate_cache(pager)
+	return true
+}
+
+/*
+ * A journal is hot when the process that wrote it is gone: no process
+ * holds the reserved lock. A WAL is hot when no other process has the
+ * database open in WAL mode; the pager's own log never is.
+ */
+func pager_has_hot_journal(pager *Pager) bool {
+	if _, err := os.Stat(pager.fileName + WAL_SUFFIX); err == nil && pager.walFile == nil &&
+		!range_is_locked(pager.fileDescriptor, LOCK_WAL_BYTE, 1) {
+		return true
+	}
+	if _, err := os.Stat(pager.fileName + JOURNAL_SUFFIX); err != nil {
+		return false
+	}
+	return !range_is_locked(pager.fileDescriptor, LOCK_RESERVED_BYTE, 1)
+}
+
+/*
+ * Release every lock on the database file but the one on the journal mode
+ */
+func pager_unlock(pager *Pager) {
+	if pager.lock == LOCK_NONE {
+		return
+	}
+	lock_range(pager.fileDescriptor, syscall.F_UNLCK, LOCK_PENDING_BYTE, 2+LOCK_SHARED_SIZE)
+	pager.lock = LOCK_NONE
+}
+
+/*
+ * Return false when the database file was set to a byte range lock that
+ * another process holds
+ */
+func lock_range(fd *os.File, lockType int16, start int64, length int64) bool {
+	lock := syscall.Flock_t{Type: lockType, Whence: io.SeekStart, Start: start, Len: length}
+	err := syscall.FcntlFlock(fd.Fd(), syscall.F_SETLK, &lock)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return false
+	}
+	if err != nil {
+		fmt.Printf("Error locking file. %v\n", err)
+		os.Exit(1)
+	}
+	return true
+}
+
+/*
+ * Set a byte range lock, waiting for other processes to let go of it
+ */
+func wait_lock_range(fd *os.File, lockType int16, start int64, length int64) {
+	lock := syscall.Flock_t{Type: lockType, Whence: io.SeekStart, Start: start, Len: length}
+	for {
+		err := syscall.FcntlFlock(fd.Fd(), syscall.F_SETLKW, &lock)
+		if err == nil {
+			return
+		}
+		if err != syscall.EINTR {
+			fmt.Printf("Error locking file. %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func range_is_locked(fd *os.File, start int64, length int64) bool {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart, Start: start, Len: length}
+	if err := syscall.FcntlFlock(fd.Fd(), syscall.F_GETLK, &lock); err != nil {
+		fmt.Printf("Error locking file. %v\n", err)
+		os.Exit(1)
+	}
+	return lock.Type != syscall.F_UNLCK
+}
+
+func pager_is_current_file(pager *Pager) bool {
+	pathInfo, err := os.Stat(pager.fileName)
+	if err != nil {
+		return true
+	}
+	fileInfo, err := pager.fileDescriptor.Stat()
+	if err != nil {
+		fmt.Printf("Error reading file. %v\n", err)
+		os.Exit(1)
+	}
+	return os.SameFile(pathInfo, fileInfo)
+}
+
+/*
+ * Switch to the file now at the pager's path. Must not be called while
+ * holding a lock, closing the old file releases it.
+ */
+func pager_reopen(pager *Pager) {
+	fd, err := os.OpenFile(pager.fileName, os.O_RDWR, 0755)
+	if err != nil {
+		fmt.Printf("Unable to open file.\n")
+		os.Exit(1)
+	}
+	pager.fileDescriptor.Close()
+	pager.fileDescriptor = fd
+	pager_lock_mode(pager)
+	pager_drop_cache(pager)
+}
+
+/*
+ * Read the change counter of the file and drop the cached pages if another
+ * process committed since they were read
+ */
+func pager_validate_cache(pager *Pager) {
+	fileLength, err := pager.fileDescriptor.Seek(0, io.SeekEnd)
+	if err != nil {
+		fmt.Printf("Error seeking. %v\n", err)
+		os.Exit(1)
+	}
+	pager.fileLength = fileLength
+	pager.numPages = 0
+	if fileLength == 0 {
+		pager_drop_cache(pager)
+		return
+	}
+
+	header := make([]byte, HEADER_SIZE)
+	if _, err := pager.fileDescriptor.ReadAt(header, 0); err != nil {
+		fmt.Printf("File is not a database.\n")
+		os.Exit(1)
+	}
+	validate_header(header, fileLength)
+	pager.numPages = uint32(fileLength / int64(header_page_size(header)))
+	/* In WAL mode the file only changes in a checkpoint, commits are found in the log */
+	if pager.walFile != nil {
+		wal_refresh(pager)
+		return
+	}
+	if header_change_counter(header) != pager.changeCounter {
+		pager_drop_cache(pager)
+		pager.changeCounter = header_change_counter(header)
+	}
+}
+
+func pager_drop_cache(pager *Pager) {
+	pager.pages = make(map[uint32]*CachedPage)
+	pager.lru = list.New()
+}
+
+/*
+ * Restore the database file from a journal left behind by a crash
+ */
+func recover_hot_journal(fd *os.File, journalName string) {
+	journal, err := os.Open(journalName)
+	if err != nil {
+		return
+	}
+	header := make([]byte, JOURNAL_HEADER_SIZE)
+	_, err = io.ReadFull(journal, header)
+	/* The file is only written after the header is on disk, so a journal without one is not hot */
+	if err == nil && string(journal_magic(header)) == JOURNAL_MAGIC {
+		validate_journal_page_size(fd, journal_page_size(header), "journal")
+		journal_playback(fd, journal, header)
+		if err := fd.Sync(); err != nil {
+			fmt.Printf("Error syncing file. %v\n", err)
+			os.Exit(1)
+		}
+	}
+	journal.Close()
+	if err := os.Remove(journalName); err != nil {
+		fmt.Printf("Error deleting journal. %v\n", err)
+		os.Exit(1)
+	}
+	sync_directory(journalName)
+}
+
+/*
+ * Refuse to play back a journal or log written with a page size the
+ * database cannot have. Both files are left as they are.
+ */
+func validate_journal_page_size(fd *os.File, pageSize uint32, kind string) {
+	if !is_valid_page_size(uint(pageSize)) {
+		fmt.Printf("Unsupported %s page size %d.\n", kind, pageSize)
+		os.Exit(1)
+	}
+	/* A file too short for a header was still being created, any page size fits it */
+	header := make([]byte, HEADER_SIZE)
+	if _, err := fd.ReadAt(header, 0); err != nil || string(header_magic(header)) != HEADER_MAGIC {
+		return
+	}
+	if header_page_size(header) != pageSize {
+		fmt.Printf("The %s page size %d does not match the database page size %d.\n", kind, pageSize, header_page_size(header))
+		os.Exit(1)
+	}
+}
+
+/*
+ * Write the original page images of the journal back to the database file
+ * and cut off the pages appended since the journal was started. A torn
+ * record at the end fails its page checksum and ends the playback.
+ */
+func journal_playback(fd *os.File, journal io.Reader, header []byte) {
+	pageSize := journal_page_size(header)
+	configure_page_layout(pageSize)
+	record := make([]byte, JOURNAL_RECORD_PAGE_NUM_SIZE+pageSize)
+	for {
+		if _, err := io.ReadFull(journal, record); err != nil {
+			break
+		}
+		pageNum := binary.LittleEndian.Uint32(record)
+		page := record[JOURNAL_RECORD_PAGE_NUM_SIZE:]
+		if page_checksum(page) != compute_page_checksum(page) {
+			break
+		}
+		if _, err := fd.WriteAt(page, int64(pageNum)*int64(pageSize)); err != nil {
+			fmt.Printf("Error writing. %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := fd.Truncate(int64(journal_page_count(header)) * int64(pageSize)); err != nil {
+		fmt.Printf("Error truncating file. %v\n", err)
+		os.Exit(1)
+	}
+}
+
+/*
+ * Make the creation or removal of a file in the directory durable
+ */
+func sync_directory(fileName string) {
+	dir, err := os.Open(filepath.Dir(fileName))
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+/*
+ * Append the original image of a page to the journal before it is first
+ * modified, starting the journal if this is the first modified page
+ */
+func pager_journal_page(pager *Pager, pagenum uint32) {
+	if pager.journalFile == nil {
+		journal, err := os.OpenFile(pager.fileName+JOURNAL_SUFFIX, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			fmt.Printf("Unable to open journal. %v\n", err)
+			os.Exit(1)
+		}
+		pager.journalFile = journal
+		pager.journalNumPages = uint32(pager.fileLength / int64(PAGE_SIZE))
+		header := make([]byte, JOURNAL_HEADER_SIZE)
+		copy(journal_magic(header), JOURNAL_MAGIC)
+		set_journal_page_size(header, PAGE_SIZE)
+		set_journal_page_count(header, pager.journalNumPages)
+		journal_write(pager, header)
+	}
+
+	/* Pages appended since the journal was started are cut off by the playback */
+	if pager.journaledPages[pagenum] || pagenum >= pager.journalNumPages {
+		return
+	}
+	record := make([]byte, JOURNAL_RECORD_PAGE_NUM_SIZE, JOURNAL_RECORD_PAGE_NUM_SIZE+PAGE_SIZE)
+	binary.LittleEndian.PutUint32(record, pagenum)
+	record = append(record, pager.pages[pagenum].data...)
+	journal_write(pager, record)
+	pager.journaledPages[pagenum] = true
+	pager.stats.journalWrites += 1
+}
+
+func journal_write(pager *Pager, data []byte) {
+	if _, err := pager.journalFile.Write(data); err != nil {
+		fmt.Printf("Error writing journal. %v\n", err)
+		os.Exit(1)
+	}
+	pager.journalSynced = false
+}
+
+/*
+ * Put the journal on disk before a modified page overwrites the original
+ */
+func pager_sync_journal(pager *Pager) {
+	if pager.journalFile == nil || pager.journalSynced {
+		return
+	}
+	if pager.synchronous >= SYNCHRONOUS_NORMAL {
+		if err := pager.journalFile.Sync(); err != nil {
+			fmt.Printf("Error syncing journal. %v\n", err)
+			os.Exit(1)
+		}
+		sync_directory(pager.fileName)
+	}
+	pager.journalSynced = true
+}
+
+/*
+ * Write every modified page to the database file and make it durable.
+ * Deleting the journal is the commit point.
+ */
+func pager_commit(pager *Pager) bool {
+	if !pager.modified {
+		pager.savepoints = nil
+		return true
+	}
+	/* Writing the file needs every reader out of the way */
+	if pager.walFile == nil && !pager_lock(pager, LOCK_EXCLUSIVE) {
+		return false
+	}
+	pager.savepoints = nil
+
+	header := get_page(pager, HEADER_PAGE_NUM)
+	pager_mark_dirty(pager, HEADER_PAGE_NUM)
+	set_header_page_count(header, pager.numPages)
+	set_header_change_counter(header, header_change_counter(header)+1)
+	pager.changeCounter = header_change_counter(header)
+	pager.modified = false
+	if pager.walFile != nil {
+		wal_commit(pager)
+		return true
+	}
+	for pageNum, page := range pager.pages {
+		if page.dirty {
+			pager_flush(pager, pageNum)
+		}
+	}
+	/* Pages written out before a rollback to a savepoint freed them */
+	if pager.fileLength > int64(pager.numPages)*int64(PAGE_SIZE) {
+		pager.fileLength = int64(pager.numPages) * int64(PAGE_SIZE)
+		if err := pager.fileDescriptor.Truncate(pager.fileLength); err != nil {
+			fmt.Printf("Error truncating file. %v\n", err)
+			os.Exit(1)
+		}
+	}
+	pager_end_journal(pager)
+	return true
+}
+
+/*
+ * Make the database file durable and delete the journal, which leaves the
+ * file in whatever state it is in now. Until the deletion is on disk a
+ * power loss can bring the journal back, which only undoes the commit.
+ */
+func pager_end_journal(pager *Pager) {
+	if pager.synchronous >= SYNCHRONOUS_NORMAL {
+		if err := pager.fileDescriptor.Sync(); err != nil {
+			fmt.Printf("Error syncing file. %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	pager.journalFile.Close()
+	if err := os.Remove(pager.fileName + JOURNAL_SUFFIX); err != nil {
+		fmt.Printf("Error deleting journal. %v\n", err)
+		os.Exit(1)
+	}
+	if pager.synchronous >= SYNCHRONOUS_FULL {
+		sync_directory(pager.fileName)
+	}
+	pager.journalFile = nil
+	pager.journaledPages = make(map[uint32]bool)
+}
+
+/*
+ * Undo every change since the last commit: play the journal back into the
+ * file, or drop the uncommitted frames of the log, and forget the cached
+ * pages so they are read again
+ */
+func pager_rollback(pager *Pager) {
+	pager.savepoints = nil
+	if !pager.modified {
+		return
+	}
+
+	if pager.walFile != nil {
+		wal_rollback(pager)
+	} else if pager.lock < LOCK_EXCLUSIVE {
+		/* Nothing was written to the file without the exclusive lock */
+		pager.numPages = pager.journalNumPages
+		pager_end_journal(pager)
+	} else {
+		header := make([]byte, JOURNAL_HEADER_SIZE)
+		if _, err := pager.journalFile.ReadAt(header, 0); err != nil {
+			fmt.Printf("Error reading journal. %v\n", err)
+			os.Exit(1)
+		}
+		pager.journalFile.Seek(JOURNAL_HEADER_SIZE, io.SeekStart)
+		journal_playback(pager.fileDescriptor, pager.journalFile, header)
+		pager.fileLength = int64(pager.journalNumPages) * int64(PAGE_SIZE)
+		pager.numPages = pager.journalNumPages
+		pager_end_journal(pager)
+	}
+
+	pager_drop_cache(pager)
+	pager.modified = false
+}
+
+/*
+ * Append every modified page to the log, ending with the header page as
+ * the commit frame, and make the log durable. Syncing the commit frame is
+ * the commit point; below full synchronous a power loss can drop it, and
+ * the commits after the last checkpoint with it.
+ */
+func wal_commit(pager *Pager) {
+	header := pager.pages[HEADER_PAGE_NUM]
+	header.dirty = true
+	for pageNum, page := range pager.pages {
+		if page.dirty && pageNum != HEADER_PAGE_NUM {
+			pager_flush(pager, pageNum)
+		}
+	}
+	set_page_checksum(header.data, compute_page_checksum(header.data))
+	wal_append_frame(pager, header.data, HEADER_PAGE_NUM, pager.numPages)
+	header.dirty = false
+	if pager.synchronous >= SYNCHRONOUS_FULL {
+		if err := pager.walFile.Sync(); err != nil {
+			fmt.Printf("Error syncing WAL. %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	for pageNum, offset := range pager.walPending {
+		pager.walIndex[pageNum] = offset
+	}
+	clear(pager.walPending)
+	pager.walNumPages = pager.numPages
+	/* While other processes are reading the log grows until a later commit */
+	if pager.walNumFrames >= WAL_AUTOCHECKPOINT_FRAMES && pager_lock_until(pager, LOCK_EXCLUSIVE, time.Now()) {
+		pager_checkpoint(pager)
+	}
+}
+
+/*
+ * Open the log of a pager in WAL mode, which other processes may be using
+ * already, and index its committed frames. Called with the shared lock.
+ */
+func wal_open(pager *Pager) {
+	wal, err := os.OpenFile(pager.fileName+WAL_SUFFIX, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Printf("Unable to open WAL. %v\n", err)
+		os.Exit(1)
+	}
+	pager.walFile = wal
+	pager.walIndex = make(map[uint32]int64)
+	pager.walPending = make(map[uint32]int64)
+	pager.walNumFrames = 0
+	pager.walCheckpoints = 0
+	wal_refresh(pager)
+}
+
+/*
+ * Read the header of a log. A log without a complete header has no frames.
+ */
+func wal_read_header(wal *os.File) ([]byte, bool) {
+	header := make([]byte, WAL_HEADER_SIZE)
+	if _, err := wal.ReadAt(header, 0); err != nil || string(wal_magic(header)) != WAL_MAGIC {
+		return nil, false
+	}
+	return header, true
+}
+
+func wal_write_header(pager *Pager) {
+	header := make([]byte, WAL_HEADER_SIZE)
+	copy(wal_magic(header), WAL_MAGIC)
+	set_wal_page_size(header, PAGE_SIZE)
+	set_wal_checkpoint_seq(header, pager.walCheckpoints)
+	if _, err := pager.walFile.WriteAt(header, 0); err != nil {
+		fmt.Printf("Error writing WAL. %v\n", err)
+		os.Exit(1)
+	}
+}
+
+/*
+ * Index the commits other processes appended to the log since the pager
+ * last read it, starting over when a checkpoint emptied the log meanwhile.
+ * Return true when there were any; the cached pages are dropped then.
+ */
+func wal_refresh(pager *Pager) bool {
+	changed := false
+	header, ok := wal_read_header(pager.walFile)
+	if !ok || wal_checkpoint_seq(header) != pager.walCheckpoints {
+		changed = pager.walNumFrames > 0 || ok
+		clear(pager.walIndex)
+		pager.walNumFrames = 0
+	}
+	if ok {
+		if wal_page_size(header) != PAGE_SIZE {
+			fmt.Printf("The WAL page size %d does not match the database page size %d.\n", wal_page_size(header), PAGE_SIZE)
+			os.Exit(1)
+		}
+		pager.walCheckpoints = wal_checkpoint_seq(header)
+		numPages, numFrames := wal_scan(pager.walFile, pager.walIndex, pager.walNumFrames)
+		if numFrames > pager.walNumFrames {
+			pager.walNumFrames = numFrames
+			pager.walNumPages = numPages
+			changed = true
+		}
+	}
+
+	if pager.walNumFrames == 0 {
+		pager.walNumPages = uint32(pager.fileLength / int64(PAGE_SIZE))
+	}
+	pager.numPages = pager.walNumPages
+	if changed {
+		pager_drop_cache(pager)
+	}
+	return changed
+}
+
+/*
+ * Get the log ready for the pager that took the reserved lock: index the
+ * newest commits, cut off the frames a crashed writer left after them and
+ * write the header of a new log. Return true when other processes
+ * committed since the pager last read the log.
+ */
+func wal_begin_write(pager *Pager) bool {
+	changed := wal_refresh(pager)
+	if _, ok := wal_read_header(pager.walFile); !ok {
+		wal_write_header(pager)
+	}
+	end := int64(WAL_HEADER_SIZE) + int64(pager.walNumFrames)*int64(WAL_FRAME_HEADER_SIZE+PAGE_SIZE)
+	if err := pager.walFile.Truncate(end); err != nil {
+		fmt.Printf("Error truncating WAL. %v\n", err)
+		os.Exit(1)
+	}
+	return changed
+}
+
+/*
+ * Copy the committed frames of a log left behind by a crash into the
+ * database file. Frames after the last commit frame are discarded.
+ */
+func recover_wal(fd *os.File, walName string) {
+	wal, err := os.Open(walName)
+	if err != nil {
+		return
+	}
+	if header, ok := wal_read_header(wal); ok {
+		pageSize := wal_page_size(header)
+		validate_journal_page_size(fd, pageSize, "WAL")
+		configure_page_layout(pageSize)
+		index := make(map[uint32]int64)
+		numPages, numFrames := wal_scan(wal, index, 0)
+		if numFrames > 0 {
+			wal_copy_frames(fd, wal, index, numPages)
+			if err := fd.Sync(); err != nil {
+				fmt.Printf("Error syncing file. %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	wal.Close()
+	if err := os.Remove(walName); err != nil {
+		fmt.Printf("Error deleting WAL. %v\n", err)
+		os.Exit(1)
+	}
+	sync_directory(walName)
+}
+
+/*
+ * Read the frames of a log from frame numFrames up to the first torn one
+ * and add the offset of each committed frame to the index, replacing the
+ * older frames of its page. Return the database size recorded by the last
+ * commit and the number of frames up to it, numFrames if there was none.
+ */
+func wal_scan(wal *os.File, index map[uint32]int64, numFrames uint32) (uint32, uint32) {
+	pending := make(map[uint32]int64)
+	numPages := uint32(0)
+	frame := make([]byte, WAL_FRAME_HEADER_SIZE+PAGE_SIZE)
+	for i := numFrames; ; i++ {
+		offset := int64(WAL_HEADER_SIZE) + int64(i)*int64(len(frame))
+		if _, err := wal.ReadAt(frame, offset); err != nil || wal_frame_checksum(frame) != compute_frame_checksum(frame) {
+			break
+		}
+		pending[wal_frame_page_num(frame)] = offset
+		if commit := wal_frame_commit(frame); commit != 0 {
+			for pageNum, frameOffset := range pending {
+				index[pageNum] = frameOffset
+			}
+			clear(pending)
+			numPages = commit
+			numFrames = i + 1
+		}
+	}
+	return numPages, numFrames
+}
+
+/*
+ * Write the page image of each indexed frame to the database file and
+ * cut the file to the committed size
+ */
+func wal_copy_frames(fd *os.File, wal *os.File, index map[uint32]int64, numPages uint32) {
+	page := make([]byte, PAGE_SIZE)
+	for pageNum, offset := range index {
+		if _, err := wal.ReadAt(page, offset+WAL_FRAME_HEADER_SIZE); err != nil {
+			fmt.Printf("Error reading WAL. %v\n", err)
+			os.Exit(1)
+		}
+		if _, err := fd.WriteAt(page, int64(pageNum)*int64(PAGE_SIZE)); err != nil {
+			fmt.Printf("Error writing. %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := fd.Truncate(int64(numPages) * int64(PAGE_SIZE)); err != nil {
+		fmt.Printf("Error truncating file. %v\n", err)
+		os.Exit(1)
+	}
+}
+
+/*
+ * Append a page to the log as a frame and return its offset.
+ * commit is the database size for the frame that ends a commit, 0 otherwise.
+ */
+func wal_append_frame(pager *Pager, page []byte, pageNum uint32, commit uint32) int64 {
+	frame := make([]byte, WAL_FRAME_HEADER_SIZE, WAL_FRAME_HEADER_SIZE+PAGE_SIZE)
+	set_wal_frame_page_num(frame, pageNum)
+	set_wal_frame_commit(frame, commit)
+	frame = append(frame, page...)
+	set_wal_frame_checksum(frame, compute_frame_checksum(frame))
+
+	offset := int64(WAL_HEADER_SIZE) + int64(pager.walNumFrames)*int64(len(frame))
+	if _, err := pager.walFile.WriteAt(frame, offset); err != nil {
+		fmt.Printf("Error writing WAL. %v\n", err)
+		os.Exit(1)
+	}
+	pager.walNumFrames += 1
+	pager.stats.walWrites += 1
+	pager.walPending[pageNum] = offset
+	return offset
+}
+
+func pager_savepoint(pager *Pager, name string) {
+	savepoint := &Savepoint{}
+	savepoint.name = name
+	savepoint.numPages = pager.numPages
+	savepoint.pages = make(map[uint32][]byte)
+	pager.savepoints = append(pager.savepoints, savepoint)
+}
+
+/*
+ * Return the index of the newest savepoint with a name, or -1
+ */
+func pager_find_savepoint(pager *Pager, name string) int {
+	for i := len(pager.savepoints) - 1; i >= 0; i-- {
+		if strings.Compare(pager.savepoints[i].name, name) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ * Save the image of a page before it is first modified after the newest savepoint
+ */
+func pager_savepoint_page(pager *Pager, pagenum uint32) {
+	if len(pager.savepoints) == 0 {
+		return
+	}
+	savepoint := pager.savepoints[len(pager.savepoints)-1]
+	/* Pages appended since the savepoint are dropped by a rollback to it */
+	if _, ok := savepoint.pages[pagenum]; ok || pagenum >= savepoint.numPages {
+		return
+	}
+	savepoint.pages[pagenum] = bytes.Clone(pager.pages[pagenum].data)
+}
+
+/*
+ * Drop the savepoint at index and the ones after it. The savepoint before
+ * it takes over the images it does not have yet, so rolling back to it
+ * still restores them.
+ */
+func pager_release(pager *Pager, index int) {
+	if index > 0 {
+		previous := pager.savepoints[index-1]
+		for _, savepoint := range pager.savepoints[index:] {
+			for pageNum, image := range savepoint.pages {
+				if _, ok := previous.pages[pageNum]; !ok && pageNum < previous.numPages {
+					previous.pages[pageNum] = image
+				}
+			}
+		}
+	}
+	pager.savepoints = pager.savepoints[:index]
+}
+
+/*
+ * Restore the pages to their images at the savepoint at index. The newest
+ * savepoint is restored first, so the older image of a page saved in more
+ * than one savepoint wins.
+ */
+func pager_rollback_to(pager *Pager, index int) {
+	target := pager.savepoints[index]
+	for i := len(pager.savepoints) - 1; i >= index; i-- {
+		for pageNum, image := range pager.savepoints[i].pages {
+			if pageNum >= target.numPages {
+				continue
+			}
+			page := get_page(pager, pageNum)
+			copy(page, image)
+			pager.pages[pageNum].dirty = true
+		}
+	}
+
+	/* Pages appended since the savepoint are forgotten */
+	for pageNum, page := range pager.pages {
+		if pageNum >= target.numPages {
+			pager.lru.Remove(page.element)
+			delete(pager.pages, pageNum)
+		}
+	}
+	pager.numPages = target.numPages
+
+	pager.savepoints = pager.savepoints[:index+1]
+	clear(target.pages)
+}
+
+/*
+ * Cut the frames written since the last commit off the log
+ */
+func wal_rollback(pager *Pager) {
+	frameSize := int64(WAL_FRAME_HEADER_SIZE + PAGE_SIZE)
+	end := int64(WAL_HEADER_SIZE) + int64(pager.walNumFrames)*frameSize
+	for _, offset := range pager.walPending {
+		end = min(end, offset)
+	}
+	if err := pager.walFile.Truncate(end); err != nil {
+		fmt.Printf("Error truncating WAL. %v\n", err)
+		os.Exit(1)
+	}
+	pager.walNumFrames = uint32((end - WAL_HEADER_SIZE) / frameSize)
+	clear(pager.walPending)
+	pager.numPages = pager.walNumPages
+}
+
+/*
+ * Copy the newest committed version of every page in the log into the
+ * database file and empty the log. Return the number of pages copied.
+ * Must be called with the exclusive lock and no uncommitted frames in the log.
+ */
+func pager_checkpoint(pager *Pager) int {
+	numCopied := len(pager.walIndex)
+	if pager.walNumFrames > 0 {
+		if pager.synchronous >= SYNCHRONOUS_NORMAL {
+			if err := pager.walFile.Sync(); err != nil {
+				fmt.Printf("Error syncing WAL. %v\n", err)
+				os.Exit(1)
+			}
+		}
+		wal_copy_frames(pager.fileDescriptor, pager.walFile, pager.walIndex, pager.walNumPages)
+		pager.stats.pageWrites += uint64(len(pager.walIndex))
+		if pager.synchronous >= SYNCHRONOUS_NORMAL {
+			if err := pager.fileDescriptor.Sync(); err != nil {
+				fmt.Printf("Error syncing file. %v\n", err)
+				os.Exit(1)
+			}
+		}
+		pager.fileLength = int64(pager.walNumPages) * int64(PAGE_SIZE)
+
+		/* Every frame is in the file now, so the log starts over */
+		if err := pager.walFile.Truncate(WAL_HEADER_SIZE); err != nil {
+			fmt.Printf("Error truncating WAL. %v\n", err)
+			os.Exit(1)
+		}
+		pager.walCheckpoints += 1
+		wal_write_header(pager)
+	}
+	pager.walNumFrames = 0
+	clear(pager.walIndex)
+	return numCopied
+}
+
+func pager_close(pager *Pager) {
+	pager.lock = LOCK_NONE
+	if pager.walFile != nil {
+		pager.walFile.Close()
+	}
+	if err := pager.fileDescriptor.Close(); err != nil {
+		fmt.Printf("Error closing db file. %v.\n", err)
+		os.Exit(1)
+	}
+}
+
+func get_page(pager *Pager, pagenum uint32) []byte {
+	page, ok := pager.pages[pagenum]
+	if ok {
+		pager.lru.MoveToFront(page.element)
+		pager.stats.cacheHits += 1
+		return page.data
+	}
+
+	// Cache miss. Load from file
+	data, ok := pager_read_page(pager, pagenum)
+	if !ok {
+		panic(PageCorruption{pagenum})
+	}
+	page = &CachedPage{pageNum: pagenum, data: data}
+
+	if pagenum >= pager.numPages {
+		pager.numPages = pagenum + 1
+	}
+
+	page.element = pager.lru.PushFront(page)
+	pager.pages[pagenum] = page
+	return page.data
+}
+
+/*
+ * Read a page from the log or the database file, bypassing the cache. A
+ * page past the end of the file is returned zeroed. Return false when the
+ * page fails its checksum.
+ */
+func pager_read_page(pager *Pager, pagenum uint32) ([]byte, bool) {
+	data := make([]byte, PAGE_SIZE)
+	totalpages := pager.fileLength / int64(PAGE_SIZE)
+	if pager.fileLength%int64(PAGE_SIZE) != 0 {
+		totalpages += 1
+	}
+
+	// The newest version of the page is in the log, if it has one
+	frameOffset, inWal := pager.walPending[pagenum]
+	if !inWal {
+		frameOffset, inWal = pager.walIndex[pagenum]
+	}
+
+	// Load the bytes to page if the page num exists in the persistent file
+	if inWal {
+		if _, err := pager.walFile.ReadAt(data, frameOffset+WAL_FRAME_HEADER_SIZE); err != nil {
+			fmt.Printf("Error reading WAL. %v\n", err)
+			os.Exit(1)
+		}
+	} else if int64(pagenum) < totalpages {
+		pager.fileDescriptor.Seek(int64(pagenum)*int64(PAGE_SIZE), 0)
+		_, err := pager.fileDescriptor.Read(data)
+		if err != nil {
+			fmt.Printf("Error reading file. %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if inWal || int64(pagenum) < totalpages {
+		pager.stats.pageReads += 1
+		if page_checksum(data) != compute_page_checksum(data) {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func pager_mark_dirty(pager *Pager, pagenum uint32) {
+	page, ok := pager.pages[pagenum]
+	if !ok {
+		fmt.Printf("Tried to mark page %d dirty while it is not cached.\n", pagenum)
+		os.Exit(1)
+	}
+	if pager.walFile == nil {
+		pager_journal_page(pager, pagenum)
+	}
+	pager_savepoint_page(pager, pagenum)
+	page.dirty = true
+	pager.modified = true
+}
+
+func pager_pin(pager *Pager, pagenum uint32) {
+	get_page(pager, pagenum)
+	pager.pages[pagenum].pinCount += 1
+}
+
+func pager_unpin(pager *Pager, pagenum uint32) {
+	pager.pages[pagenum].pinCount -= 1
+}
+
+/*
+ * Evict least recently used pages until the cache is back within its size,
+ * writing dirty pages back first. Pages handed out by get_page stay valid
+ * until the next trim, so this is only called where no caller holds on to
+ * a page: between commands and when a cursor moves to another leaf.
+ */
+func pager_trim_cache(pager *Pager) {
+	element := pager.lru.Back()
+	for uint32(len(pager.pages)) > pager.cacheSize && element != nil {
+		page := element.Value.(*CachedPage)
+		element = element.Prev()
+		if page.pinCount > 0 {
+			continue
+		}
+		/* Without the exclusive lock dirty pages stay cached until the commit */
+		if page.dirty && pager.walFile == nil && !pager_lock_until(pager, LOCK_EXCLUSIVE, time.Now()) {
+			continue
+		}
+		if page.dirty {
+			pager_flush(pager, page.pageNum)
+		}
+		pager.lru.Remove(page.element)
+		delete(pager.pages, page.pageNum)
+	}
+}
+
+/*
+ * Return a page num for a new page, reusing a page from the free list when
+ * there is one. The caller is expected to initialize the page.
+ */
+func get_unused_page_num(pager *Pager) uint32 {
+	header := get_page(pager, HEADER_PAGE_NUM)
+	trunkPageNum := freelist_trunk_page(header)
+	if trunkPageNum == 0 {
+		return pager.numPages
+	}
+
+	pager_mark_dirty(pager, HEADER_PAGE_NUM)
+	set_freelist_page_count(header, freelist_page_count(header)-1)
+	trunk := get_page(pager, trunkPageNum)
+	pager_mark_dirty(pager, trunkPageNum)
+	numLeaves := freelist_num_leaves(trunk)
+	if numLeaves > 0 {
+		set_freelist_num_leaves(trunk, numLeaves-1)
+		return freelist_leaf(trunk, numLeaves-1)
+	}
+	/* The trunk has no leaves left, so it is handed out itself */
+	set_freelist_trunk_page(header, freelist_next_trunk(trunk))
+	return trunkPageNum
+}
+
+/*
+ * Put a page that is no longer used by the tree on the free list
+ */
+func free_page(pager *Pager, pageNum uint32) {
+	header := get_page(pager, HEADER_PAGE_NUM)
+	trunkPageNum := freelist_trunk_page(header)
+	pager_mark_dirty(pager, HEADER_PAGE_NUM)
+	set_freelist_page_count(header, freelist_page_count(header)+1)
+
+	if trunkPageNum != 0 {
+		trunk := get_page(pager, trunkPageNum)
+		pager_mark_dirty(pager, trunkPageNum)
+		numLeaves := freelist_num_leaves(trunk)
+		if numLeaves < FREELIST_TRUNK_MAX_LEAVES {
+			set_freelist_leaf(trunk, numLeaves, pageNum)
+			set_freelist_num_leaves(trunk, numLeaves+1)
+			return
+		}
+	}
+	/* The first trunk is full (or missing), so the page becomes the new first trunk */
+	newTrunk := get_page(pager, pageNum)
+	pager_mark_dirty(pager, pageNum)
+	set_freelist_next_trunk(newTrunk, trunkPageNum)
+	set_freelist_num_leaves(newTrunk, 0)
+	set_freelist_trunk_page(header, pageNum)
+}
+
+func header_magic(header []byte) []byte {
+	return header[HEADER_MAGIC_OFFSET : HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE]
+}
+
+func header_format_version(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[HEADER_FORMAT_VERSION_OFFSET:])
+}
+
+func set_header_format_version(header []byte, version uint32) {
+	binary.LittleEndian.PutUint32(header[HEADER_FORMAT_VERSION_OFFSET:], version)
+}
+
+func header_page_size(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[HEADER_PAGE_SIZE_OFFSET:])
+}
+
+func set_header_page_size(header []byte, pageSize uint32) {
+	binary.LittleEndian.PutUint32(header[HEADER_PAGE_SIZE_OFFSET:], pageSize)
+}
+
+func header_root_page(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[HEADER_ROOT_PAGE_OFFSET:])
+}
+
+func set_header_root_page(header []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(header[HEADER_ROOT_PAGE_OFFSET:], pageNum)
+}
+
+func header_page_count(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[HEADER_PAGE_COUNT_OFFSET:])
+}
+
+func set_header_page_count(header []byte, numPages uint32) {
+	binary.LittleEndian.PutUint32(header[HEADER_PAGE_COUNT_OFFSET:], numPages)
+}
+
+func header_schema_cookie(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[HEADER_SCHEMA_COOKIE_OFFSET:])
+}
+
+func set_header_schema_cookie(header []byte, cookie uint32) {
+	binary.LittleEndian.PutUint32(header[HEADER_SCHEMA_COOKIE_OFFSET:], cookie)
+}
+
+func header_change_counter(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[HEADER_CHANGE_COUNTER_OFFSET:])
+}
+
+func set_header_change_counter(header []byte, counter uint32) {
+	binary.LittleEndian.PutUint32(header[HEADER_CHANGE_COUNTER_OFFSET:], counter)
+}
+
+func header_key_types(header []byte) []byte {
+	return header[HEADER_KEY_TYPES_OFFSET : HEADER_KEY_TYPES_OFFSET+HEADER_KEY_TYPES_SIZE]
+}
+
+/*
+ * Return the key component types recorded in the header
+ */
+func read_key_types(header []byte) []KeyType {
+	keyTypes := []KeyType{}
+	for _, keyType := range header_key_types(header) {
+		if KeyType(keyType) == KEY_TYPE_NONE {
+			break
+		}
+		keyTypes = append(keyTypes, KeyType(keyType))
+	}
+	return keyTypes
+}
+
+func journal_magic(header []byte) []byte {
+	return header[JOURNAL_MAGIC_OFFSET : JOURNAL_MAGIC_OFFSET+JOURNAL_MAGIC_SIZE]
+}
+
+func journal_page_size(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[JOURNAL_PAGE_SIZE_OFFSET:])
+}
+
+func set_journal_page_size(header []byte, pageSize uint32) {
+	binary.LittleEndian.PutUint32(header[JOURNAL_PAGE_SIZE_OFFSET:], pageSize)
+}
+
+func journal_page_count(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[JOURNAL_PAGE_COUNT_OFFSET:])
+}
+
+func set_journal_page_count(header []byte, numPages uint32) {
+	binary.LittleEndian.PutUint32(header[JOURNAL_PAGE_COUNT_OFFSET:], numPages)
+}
+
+func wal_magic(header []byte) []byte {
+	return header[WAL_MAGIC_OFFSET : WAL_MAGIC_OFFSET+WAL_MAGIC_SIZE]
+}
+
+func wal_page_size(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[WAL_PAGE_SIZE_OFFSET:])
+}
+
+func set_wal_page_size(header []byte, pageSize uint32) {
+	binary.LittleEndian.PutUint32(header[WAL_PAGE_SIZE_OFFSET:], pageSize)
+}
+
+func wal_checkpoint_seq(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[WAL_CHECKPOINT_SEQ_OFFSET:])
+}
+
+func set_wal_checkpoint_seq(header []byte, checkpointSeq uint32) {
+	binary.LittleEndian.PutUint32(header[WAL_CHECKPOINT_SEQ_OFFSET:], checkpointSeq)
+}
+
+func wal_frame_page_num(frame []byte) uint32 {
+	return binary.LittleEndian.Uint32(frame[WAL_FRAME_PAGE_NUM_OFFSET:])
+}
+
+func set_wal_frame_page_num(frame []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_PAGE_NUM_OFFSET:], pageNum)
+}
+
+func wal_frame_commit(frame []byte) uint32 {
+	return binary.LittleEndian.Uint32(frame[WAL_FRAME_COMMIT_OFFSET:])
+}
+
+func set_wal_frame_commit(frame []byte, numPages uint32) {
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_COMMIT_OFFSET:], numPages)
+}
+
+func wal_frame_checksum(frame []byte) uint32 {
+	return binary.LittleEndian.Uint32(frame[WAL_FRAME_CHECKSUM_OFFSET:])
+}
+
+func set_wal_frame_checksum(frame []byte, checksum uint32) {
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_CHECKSUM_OFFSET:], checksum)
+}
+
+func compute_frame_checksum(frame []byte) uint32 {
+	checksum := crc32.Checksum(frame[:WAL_FRAME_CHECKSUM_OFFSET], CHECKSUM_TABLE)
+	return crc32.Update(checksum, CHECKSUM_TABLE, frame[WAL_FRAME_HEADER_SIZE:])
+}
+
+func freelist_trunk_page(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[FREELIST_TRUNK_PAGE_OFFSET:])
+}
+
+func set_freelist_trunk_page(header []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(header[FREELIST_TRUNK_PAGE_OFFSET:], pageNum)
+}
+
+func freelist_page_count(header []byte) uint32 {
+	return binary.LittleEndian.Uint32(header[FREELIST_PAGE_COUNT_OFFSET:])
+}
+
+func set_freelist_page_count(header []byte, numPages uint32) {
+	binary.LittleEndian.PutUint32(header[FREELIST_PAGE_COUNT_OFFSET:], numPages)
+}
+
+func freelist_next_trunk(trunk []byte) uint32 {
+	return binary.LittleEndian.Uint32(trunk[FREELIST_NEXT_TRUNK_OFFSET:])
+}
+
+func set_freelist_next_trunk(trunk []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(trunk[FREELIST_NEXT_TRUNK_OFFSET:], pageNum)
+}
+
+func freelist_num_leaves(trunk []byte) uint32 {
+	return binary.LittleEndian.Uint32(trunk[FREELIST_NUM_LEAVES_OFFSET:])
+}
+
+func set_freelist_num_leaves(trunk []byte, numLeaves uint32) {
+	binary.LittleEndian.PutUint32(trunk[FREELIST_NUM_LEAVES_OFFSET:], numLeaves)
+}
+
+func freelist_leaf(trunk []byte, leafNum uint32) uint32 {
+	return binary.LittleEndian.Uint32(trunk[FREELIST_TRUNK_HEADER_SIZE+leafNum*FREELIST_LEAF_SIZE:])
+}
+
+func set_freelist_leaf(trunk []byte, leafNum uint32, pageNum uint32) {
+	binary.LittleEndian.PutUint32(trunk[FREELIST_TRUNK_HEADER_SIZE+leafNum*FREELIST_LEAF_SIZE:], pageNum)
+}
+
+func page_checksum(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[PAGE_USABLE_SIZE:])
+}
+
+func set_page_checksum(page []byte, checksum uint32) {
+	binary.LittleEndian.PutUint32(page[PAGE_USABLE_SIZE:], checksum)
+}
+
+func compute_page_checksum(page []byte) uint32 {
+	return crc32.Checksum(page[:PAGE_USABLE_SIZE], CHECKSUM_TABLE)
+}
+
+func pager_flush(pager *Pager, pagenum uint32) {
+	page, ok := pager.pages[pagenum]
+	if !ok {
+		fmt.Printf("Tried to flush null page.\n")
+		os.Exit(1)
+	}
+
+	/* In WAL mode the file only changes during a checkpoint */
+	if pager.walFile != nil {
+		set_page_checksum(page.data, compute_page_checksum(page.data))
+		wal_append_frame(pager, page.data, pagenum, 0)
+		page.dirty = false
+		return
+	}
+
+	pager_sync_journal(pager)
+	offset := int64(pagenum) * int64(PAGE_SIZE)
+	_, err := pager.fileDescriptor.Seek(offset, 0)
+	if err != nil {
+		fmt.Printf("Error seeking. %v\n", err)
+		os.Exit(1)
+	}
+
+	set_page_checksum(page.data, compute_page_checksum(page.data))
+	_, err = pager.fileDescriptor.Write(page.data[0:PAGE_SIZE])
+	if err != nil {
 		fmt.Printf("Error writing. %v\n", err)
+		os.Exit(1)
+	}
+	page.dirty = false
+	pager.stats.pageWrites += 1
+	if offset+int64(PAGE_SIZE) > pager.fileLength {
+		pager.fileLength = offset + int64(PAGE_SIZE)
+	}
+}
+
+func table_start(table *Table) *Cursor {
+	/* Follow the first child down to the leftmost leaf */
+	pageNum := table.rootPageNum
+	node := get_page(table.pager, pageNum)
+	for get_node_type(node) == NODE_INTERNAL {
+		pageNum = internal_node_child(node, 0)
+		node = get_page(table.pager, pageNum)
+	}
+
+	cursor := &Cursor{}
+	cursor.table = table
+	cursor.pageNum = pageNum
+	cursor.cellNum = 0
+	pager_pin(table.pager, pageNum)
+
+	numCells := leaf_node_num_cells(node)
+	cursor.endOfTable = (numCells == 0)
+
+	return cursor
+}
+
+/*
+Return the position of the given key.
+If the key is not present, return the position where it should be inserted
+*/
+func table_find(table *Table, key []byte) *Cursor {
+	rootPageNum := table.rootPageNum
+	rootNode := get_page(table.pager, rootPageNum)
+	if get_node_type(rootNode) == NODE_LEAF {
+		return leaf_node_find(table, rootPageNum, key)
+	} else {
+		return internal_node_find(table, rootPageNum, key)
+	}
+}
+
+/*
+ * Return a cursor at the first key after the given key, or at the key
+ * itself when inclusive is set
+ */
+func table_seek(table *Table, key []byte, inclusive bool) *Cursor {
+	cursor := table_find(table, key)
+	node := get_page(table.pager, cursor.pageNum)
+	numCells := leaf_node_num_cells(node)
+	if cursor.cellNum < numCells && !inclusive && table.compareKeys(leaf_node_cell_key(node, cursor.cellNum), key) == 0 {
+		cursor.cellNum += 1
+	}
+
+	/* Every key of the leaf is smaller, so the position is at the start of the next leaf */
+	if cursor.cellNum >= numCells {
+		nextPageNum := leaf_node_next_leaf(node)
+		if nextPageNum == 0 {
+			cursor.endOfTable = true
+		} else {
+			pager_pin(table.pager, nextPageNum)
+			pager_unpin(table.pager, cursor.pageNum)
+			cursor.pageNum = nextPageNum
+			cursor.cellNum = 0
+		}
+	}
+	return cursor
+}
+
+/*
+ * Return a cursor at the last key of the table, for scanning backwards
+ */
+func table_end(table *Table) *Cursor {
+	pageNum := node_rightmost_leaf(table.pager, table.rootPageNum)
+	node := get_page(table.pager, pageNum)
+
+	cursor := &Cursor{}
+	cursor.table = table
+	cursor.pageNum = pageNum
+	pager_pin(table.pager, pageNum)
+
+	numCells := leaf_node_num_cells(node)
+	cursor.endOfTable = (numCells == 0)
+	if numCells > 0 {
+		cursor.cellNum = numCells - 1
+	}
+	return cursor
+}
+
+/*
+ * Return a cursor at the last key before the given key, or at the key
+ * itself when inclusive is set
+ */
+func table_seek_last(table *Table, key []byte, inclusive bool) *Cursor {
+	cursor := table_seek(table, key, !inclusive)
+	if cursor.endOfTable {
+		/* Every key is before the given key */
+		cursor_close(cursor)
+		return table_end(table)
+	}
+	cursor_retreat(cursor)
+	return cursor
+}
+
+/*
+ * End the scan of the cursor before the first key after the bound,
+ * or after the bound itself unless inclusive is set
+ */
+func cursor_set_upper_bound(cursor *Cursor, key []byte, inclusive bool) {
+	cursor.upperBound = key
+	cursor.upperInclusive = inclusive
+	cursor_check_upper_bound(cursor)
+}
+
+/*
+ * End the reverse scan of the cursor before the first key before the
+ * bound, or before the bound itself unless inclusive is set
+ */
+func cursor_set_lower_bound(cursor *Cursor, key []byte, inclusive bool) {
+	cursor.lowerBound = key
+	cursor.lowerInclusive = inclusive
+	cursor_check_lower_bound(cursor)
+}
+
+func cursor_check_lower_bound(cursor *Cursor) {
+	if cursor.endOfTable || cursor.lowerBound == nil {
+		return
+	}
+	order := cursor.table.compareKeys(leaf_node_cell_key(get_page(cursor.table.pager, cursor.pageNum), cursor.cellNum), cursor.lowerBound)
+	if order < 0 || (order == 0 && !cursor.lowerInclusive) {
+		cursor.endOfTable = true
+	}
+}
+
+func cursor_check_upper_bound(cursor *Cursor) {
+	if cursor.endOfTable || cursor.upperBound == nil {
+		return
+	}
+	order := cursor.table.compareKeys(leaf_node_cell_key(get_page(cursor.table.pager, cursor.pageNum), cursor.cellNum), cursor.upperBound)
+	if order > 0 || (order == 0 && !cursor.upperInclusive) {
+		cursor.endOfTable = true
+	}
+}
+
+func cursor_advance(cursor *Cursor) {
+	pageNum := cursor.pageNum
+	node := get_page(cursor.table.pager, pageNum)
+	cursor.cellNum += 1
+
+	/* Advance to next leaf node */
+	if cursor.cellNum >= leaf_node_num_cells(node) {
+		nextPageNum := leaf_node_next_leaf(node)
+		if nextPageNum == 0 {
+			// This was rightmost leaf
+			cursor.endOfTable = true
+		} else {
+			/* Keep the new leaf in the cache, the old one may be evicted */
+			pager_pin(cursor.table.pager, nextPageNum)
+			pager_unpin(cursor.table.pager, pageNum)
+			pager_trim_cache(cursor.table.pager)
+			cursor.pageNum = nextPageNum
+			cursor.cellNum = 0
+		}
+	}
+	cursor_check_upper_bound(cursor)
+}
+
+/*
+ * Move the cursor to the previous key, the counterpart of cursor_advance
+ */
+func cursor_retreat(cursor *Cursor) {
+	if cursor.cellNum > 0 {
+		cursor.cellNum -= 1
+		cursor_check_lower_bound(cursor)
+		return
+	}
+
+	/* Move back to previous leaf node */
+	prevPageNum := leaf_node_prev_leaf(cursor.table.pager, cursor.pageNum)
+	if prevPageNum == 0 {
+		// This was leftmost leaf
+		cursor.endOfTable = true
+		return
+	}
+	/* Keep the new leaf in the cache, the old one may be evicted */
+	pager_pin(cursor.table.pager, prevPageNum)
+	pager_unpin(cursor.table.pager, cursor.pageNum)
+	pager_trim_cache(cursor.table.pager)
+	cursor.pageNum = prevPageNum
+	cursor.cellNum = leaf_node_num_cells(get_page(cursor.table.pager, prevPageNum)) - 1
+	cursor_check_lower_bound(cursor)
+}
+
+/*
+ * Release the page pinned by the cursor
+ */
+func cursor_close(cursor *Cursor) {
+	pager_unpin(cursor.table.pager, cursor.pageNum)
+}
+
+func get_node_type(node []byte) NodeType {
+	value := node[NODE_TYPE_OFFSET]
+	return NodeType(value)
+}
+
+func set_node_type(node []byte, nodeType NodeType) {
+	node[NODE_TYPE_OFFSET] = byte(nodeType)
+}
+
+func leaf_node_num_cells(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_NUM_CELLS_OFFSET:])
+}
+
+func set_leaf_node_num_cells(node []byte, numCells uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NUM_CELLS_OFFSET:], numCells)
+}
+
+func leaf_node_cell_content_start(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_CELL_CONTENT_START_OFFSET:])
+}
+
+func set_leaf_node_cell_content_start(node []byte, offset uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_CELL_CONTENT_START_OFFSET:], offset)
+}
+
+func leaf_node_first_freeblock(node []byte) uint16 {
+	return binary.LittleEndian.Uint16(node[LEAF_NODE_FIRST_FREEBLOCK_OFFSET:])
+}
+
+func set_leaf_node_first_freeblock(node []byte, offset uint16) {
+	binary.LittleEndian.PutUint16(node[LEAF_NODE_FIRST_FREEBLOCK_OFFSET:], offset)
+}
+
+func leaf_node_fragmented_bytes(node []byte) uint16 {
+	return binary.LittleEndian.Uint16(node[LEAF_NODE_FRAGMENTED_BYTES_OFFSET:])
+}
+
+func set_leaf_node_fragmented_bytes(node []byte, numBytes uint16) {
+	binary.LittleEndian.PutUint16(node[LEAF_NODE_FRAGMENTED_BYTES_OFFSET:], numBytes)
+}
+
+func freeblock_next(node []byte, offset uint32) uint16 {
+	return binary.LittleEndian.Uint16(node[offset+FREEBLOCK_NEXT_OFFSET:])
+}
+
+func set_freeblock_next(node []byte, offset uint32, nextOffset uint16) {
+	binary.LittleEndian.PutUint16(node[offset+FREEBLOCK_NEXT_OFFSET:], nextOffset)
+}
+
+func freeblock_size(node []byte, offset uint32) uint16 {
+	return binary.LittleEndian.Uint16(node[offset+FREEBLOCK_SIZE_OFFSET:])
+}
+
+func set_freeblock_size(node []byte, offset uint32, size uint16) {
+	binary.LittleEndian.PutUint16(node[offset+FREEBLOCK_SIZE_OFFSET:], size)
+}
+
+func leaf_node_cell_pointer(node []byte, cellNum uint32) uint16 {
+	return binary.LittleEndian.Uint16(node[LEAF_NODE_HEADER_SIZE+cellNum*LEAF_NODE_CELL_POINTER_SIZE:])
+}
+
+func set_leaf_node_cell_pointer(node []byte, cellNum uint32, offset uint16) {
+	binary.LittleEndian.PutUint16(node[LEAF_NODE_HEADER_SIZE+cellNum*LEAF_NODE_CELL_POINTER_SIZE:], offset)
+}
+
+func leaf_node_cell(node []byte, cellNum uint32) []byte {
+	offset := uint32(leaf_node_cell_pointer(node, cellNum))
+	cell := node[offset:]
+	return cell[:leaf_cell_size(uint32(leaf_cell_key_size(cell)), leaf_cell_payload_size(cell))]
+}
+
+func leaf_node_cell_key(node []byte, cellNum uint32) []byte {
+	offset := uint32(leaf_node_cell_pointer(node, cellNum))
+	return leaf_cell_key(node[offset:])
+}
+
+func leaf_cell_key_size(cell []byte) uint16 {
+	return binary.LittleEndian.Uint16(cell[LEAF_NODE_KEY_SIZE_OFFSET:])
+}
+
+func set_leaf_cell_key_size(cell []byte, keySize uint16) {
+	binary.LittleEndian.PutUint16(cell[LEAF_NODE_KEY_SIZE_OFFSET:], keySize)
+}
+
+func leaf_cell_key(cell []byte) []byte {
+	return cell[LEAF_NODE_CELL_HEADER_SIZE : LEAF_NODE_CELL_HEADER_SIZE+uint32(leaf_cell_key_size(cell))]
+}
+
+func leaf_cell_payload_size(cell []byte) uint32 {
+	return binary.LittleEndian.Uint32(cell[LEAF_NODE_PAYLOAD_SIZE_OFFSET:])
+}
+
+func set_leaf_cell_payload_size(cell []byte, payloadSize uint32) {
+	binary.LittleEndian.PutUint32(cell[LEAF_NODE_PAYLOAD_SIZE_OFFSET:], payloadSize)
+}
+
+/*
+ * Return the part of the payload that is stored in the cell itself
+ */
+func leaf_cell_local_payload(cell []byte) []byte {
+	payloadOffset := LEAF_NODE_CELL_HEADER_SIZE + uint32(leaf_cell_key_size(cell))
+	localSize := leaf_cell_payload_size(cell)
+	if localSize > LEAF_NODE_MAX_LOCAL_PAYLOAD {
+		localSize = LEAF_NODE_MAX_LOCAL_PAYLOAD
+	}
+	return cell[payloadOffset : payloadOffset+localSize]
+}
+
+func leaf_cell_overflow_page(cell []byte) uint32 {
+	offset := LEAF_NODE_CELL_HEADER_SIZE + uint32(leaf_cell_key_size(cell)) + LEAF_NODE_MAX_LOCAL_PAYLOAD
+	return binary.LittleEndian.Uint32(cell[offset:])
+}
+
+func set_leaf_cell_overflow_page(cell []byte, pageNum uint32) {
+	offset := LEAF_NODE_CELL_HEADER_SIZE + uint32(leaf_cell_key_size(cell)) + LEAF_NODE_MAX_LOCAL_PAYLOAD
+	binary.LittleEndian.PutUint32(cell[offset:], pageNum)
+}
+
+/*
+ * Return the number of bytes taken in the page by a cell with the given key and payload sizes
+ */
+func leaf_cell_size(keySize uint32, payloadSize uint32) uint32 {
+	if payloadSize > LEAF_NODE_MAX_LOCAL_PAYLOAD {
+		return LEAF_NODE_CELL_HEADER_SIZE + keySize + LEAF_NODE_MAX_LOCAL_PAYLOAD + LEAF_NODE_OVERFLOW_PAGE_SIZE
+	}
+	return LEAF_NODE_CELL_HEADER_SIZE + keySize + payloadSize
+}
+
+func overflow_next_page(page []byte) uint32 {
+	return binary.LittleEndian.Uint32(page[OVERFLOW_NEXT_PAGE_OFFSET:])
+}
+
+func set_overflow_next_page(page []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(page[OVERFLOW_NEXT_PAGE_OFFSET:], pageNum)
+}
+
+/*
+ * Return the whole payload of a cell, reading the overflow chain if it has one
+ */
+func leaf_cell_payload(pager *Pager, cell []byte) []byte {
+	payloadSize := leaf_cell_payload_size(cell)
+	payload := make([]byte, 0, payloadSize)
+	payload = append(payload, leaf_cell_local_payload(cell)...)
+	if payloadSize <= LEAF_NODE_MAX_LOCAL_PAYLOAD {
+		return payload
+	}
+
+	overflowPageNum := leaf_cell_overflow_page(cell)
+	for uint32(len(payload)) < payloadSize {
+		page := get_page(pager, overflowPageNum)
+		chunkSize := payloadSize - uint32(len(payload))
+		if chunkSize > OVERFLOW_PAGE_DATA_SIZE {
+			chunkSize = OVERFLOW_PAGE_DATA_SIZE
+		}
+		payload = append(payload, page[OVERFLOW_HEADER_SIZE:OVERFLOW_HEADER_SIZE+chunkSize]...)
+		overflowPageNum = overflow_next_page(page)
+	}
+	return payload
+}
+
+/*
+ * Build the cell for a key and its payload. The part of the payload
+ * that does not fit in the cell is written to new overflow pages.
+ */
+func leaf_node_build_cell(pager *Pager, key []byte, payload []byte) []byte {
+	payloadSize := uint32(len(payload))
+	cell := make([]byte, leaf_cell_size(uint32(len(key)), payloadSize))
+	set_leaf_cell_key_size(cell, uint16(len(key)))
+	copy(leaf_cell_key(cell), key)
+	set_leaf_cell_payload_size(cell, payloadSize)
+	localPayload := leaf_cell_local_payload(cell)
+	copy(localPayload, payload)
+	if payloadSize > LEAF_NODE_MAX_LOCAL_PAYLOAD {
+		set_leaf_cell_overflow_page(cell, write_overflow_chain(pager, payload[len(localPayload):]))
+	}
+	return cell
+}
+
+/*
+ * Store the data in a chain of overflow pages and return its first page num
+ */
+func write_overflow_chain(pager *Pager, data []byte) uint32 {
+	numPages := (uint32(len(data)) + OVERFLOW_PAGE_DATA_SIZE - 1) / OVERFLOW_PAGE_DATA_SIZE
+
+	/* Write the chain back to front, so every page knows its successor */
+	nextPageNum := uint32(0)
+	for i := int(numPages) - 1; i >= 0; i-- {
+		pageNum := get_unused_page_num(pager)
+		page := get_page(pager, pageNum)
+		pager_mark_dirty(pager, pageNum)
+		set_overflow_next_page(page, nextPageNum)
+		chunk := data[uint32(i)*OVERFLOW_PAGE_DATA_SIZE:]
+		if uint32(len(chunk)) > OVERFLOW_PAGE_DATA_SIZE {
+			chunk = chunk[:OVERFLOW_PAGE_DATA_SIZE]
+		}
+		copy(page[OVERFLOW_HEADER_SIZE:], chunk)
+		nextPageNum = pageNum
+	}
+	return nextPageNum
+}
+
+/*
+ * Put the overflow pages of a cell that is being removed on the free list
+ */
+func free_overflow_chain(pager *Pager, cell []byte) {
+	if leaf_cell_payload_size(cell) <= LEAF_NODE_MAX_LOCAL_PAYLOAD {
+		return
+	}
+	overflowPageNum := leaf_cell_overflow_page(cell)
+	for overflowPageNum != 0 {
+		nextPageNum := overflow_next_page(get_page(pager, overflowPageNum))
+		free_page(pager, overflowPageNum)
+		overflowPageNum = nextPageNum
+	}
+}
+
+/*
+ * Return the number of bytes taken by the cells of the node and their pointers
+ */
+func leaf_node_used_space(node []byte) uint32 {
+	numCells := leaf_node_num_cells(node)
+	usedSpace := numCells * LEAF_NODE_CELL_POINTER_SIZE
+	for i := uint32(0); i < numCells; i++ {
+		usedSpace += uint32(len(leaf_node_cell(node, i)))
+	}
+	return usedSpace
+}
+
+func leaf_node_free_space(node []byte) uint32 {
+	return LEAF_NODE_SPACE_FOR_CELLS - leaf_node_used_space(node)
+}
+
+/*
+ * Return a copy of every cell of the node in key order
+ */
+func leaf_node_cells(node []byte) [][]byte {
+	numCells := leaf_node_num_cells(node)
+	cells := make([][]byte, numCells)
+	for i := uint32(0); i < numCells; i++ {
+		cells[i] = append([]byte(nil), leaf_node_cell(node, i)...)
+	}
+	return cells
+}
+
+/*
+ * Replace the cells of the node, packing them at the end of the page
+ */
+func leaf_node_set_cells(node []byte, cells [][]byte) {
+	set_leaf_node_num_cells(node, 0)
+	set_leaf_node_cell_content_start(node, PAGE_USABLE_SIZE)
+	set_leaf_node_first_freeblock(node, 0)
+	set_leaf_node_fragmented_bytes(node, 0)
+	for i, cell := range cells {
+		leaf_node_insert_cell(node, uint32(i), cell)
 	}
 }
 
-func table_start(table *Table) *Cursor {
-	cursor := table_find(table, 0)
+/*
+ * Move all cells to the end of the page, so the free blocks and
+ * fragmented bytes join the free space after the pointer array
+ */
+func leaf_node_defragment(node []byte) {
+	leaf_node_set_cells(node, leaf_node_cells(node))
+}
 
-	node := get_page(table.pager, cursor.pageNum)
-	numCells := *leaf_node_num_cells(node)
-	cursor.endOfTable = (numCells == 0)
+/*
+ * Reserve space for a cell in the content area and return its offset.
+ * The first free block that is large enough is used, otherwise the space
+ * comes from the gap between the pointer array and the content area.
+ * The caller makes sure the node has enough free space in total and
+ * room in the gap for the pointer to the new cell.
+ */
+func leaf_node_allocate(node []byte, size uint32) uint32 {
+	previous := uint32(0)
+	offset := uint32(leaf_node_first_freeblock(node))
+	for offset != 0 {
+		blockSize := uint32(freeblock_size(node, offset))
+		next := freeblock_next(node, offset)
+		if blockSize >= size {
+			remaining := blockSize - size
+			if remaining >= FREEBLOCK_MIN_SIZE {
+				/* Take the end of the block, so the rest stays in the chain */
+				set_freeblock_size(node, offset, uint16(remaining))
+				return offset + remaining
+			}
+			/* The rest is too small to be a free block */
+			if previous == 0 {
+				set_leaf_node_first_freeblock(node, next)
+			} else {
+				set_freeblock_next(node, previous, next)
+			}
+			set_leaf_node_fragmented_bytes(node, leaf_node_fragmented_bytes(node)+uint16(remaining))
+			return offset
+		}
+		previous = offset
+		offset = uint32(next)
+	}
 
-	return cursor
+	pointerArrayEnd := LEAF_NODE_HEADER_SIZE + (leaf_node_num_cells(node)+1)*LEAF_NODE_CELL_POINTER_SIZE
+	if leaf_node_cell_content_start(node) < pointerArrayEnd+size {
+		leaf_node_defragment(node)
+	}
+	contentStart := leaf_node_cell_content_start(node) - size
+	set_leaf_node_cell_content_start(node, contentStart)
+	return contentStart
 }
 
 /*
-Return the position of the given key.
-If the key is not present, return the position where it should be inserted
-*/
-func table_find(table *Table, key uint32) *Cursor {
-	rootPageNum := table.rootPageNum
-	rootNode := get_page(table.pager, rootPageNum)
-	if get_node_type(rootNode) == NODE_LEAF {
-		return leaf_node_find(table, rootPageNum, key)
-	} else {
-		return internal_node_find(table, rootPageNum, key)
+ * Give the space of a removed cell back to the node. The block is merged
+ * with adjacent free blocks, and with the free space before the content
+ * area when it starts the content area.
+ */
+func leaf_node_free_space_at(node []byte, offset uint32, size uint32) {
+	/* Find the free blocks before and after the freed space */
+	beforePrevious := uint32(0)
+	previous := uint32(0)
+	next := uint32(leaf_node_first_freeblock(node))
+	for next != 0 && next < offset {
+		beforePrevious = previous
+		previous = next
+		next = uint32(freeblock_next(node, next))
 	}
-}
 
-func cursor_advance(cursor *Cursor) {
-	pageNum := cursor.pageNum
-	node := get_page(cursor.table.pager, pageNum)
-	cursor.cellNum += 1
+	if next != 0 && offset+size == next {
+		size += uint32(freeblock_size(node, next))
+		next = uint32(freeblock_next(node, next))
+	}
+	if previous != 0 && previous+uint32(freeblock_size(node, previous)) == offset {
+		offset = previous
+		size += uint32(freeblock_size(node, previous))
+		previous = beforePrevious
+	}
 
-	/* Advance to next leaf node */
-	if cursor.cellNum >= *leaf_node_num_cells(node) {
-		nextPageNum := *leaf_node_next_leaf(node)
-		if nextPageNum == 0 {
-			// This was rightmost leaf
-			cursor.endOfTable = true
-		} else {
-			cursor.pageNum = nextPageNum
-			cursor.cellNum = 0
-		}
+	if offset == leaf_node_cell_content_start(node) {
+		/* Only blocks after the freed space can be left, so it is the first one */
+		set_leaf_node_first_freeblock(node, uint16(next))
+		set_leaf_node_cell_content_start(node, offset+size)
+		return
+	}
+	set_freeblock_next(node, offset, uint16(next))
+	set_freeblock_size(node, offset, uint16(size))
+	if previous == 0 {
+		set_leaf_node_first_freeblock(node, uint16(offset))
+	} else {
+		set_freeblock_next(node, previous, uint16(offset))
 	}
 }
 
-func get_node_type(node []byte) NodeType {
-	value := node[NODE_TYPE_OFFSET]
-	return NodeType(value)
-}
+/*
+ * Store a cell in the content area and insert its pointer at cellNum.
+ * The caller makes sure the node has enough free space for it.
+ */
+func leaf_node_insert_cell(node []byte, cellNum uint32, cell []byte) {
+	numCells := leaf_node_num_cells(node)
+	pointerArrayEnd := LEAF_NODE_HEADER_SIZE + (numCells+1)*LEAF_NODE_CELL_POINTER_SIZE
+	if leaf_node_cell_content_start(node) < pointerArrayEnd {
+		/* Free blocks may have room for the cell, but not the pointer */
+		leaf_node_defragment(node)
+	}
 
-func set_node_type(node []byte, nodeType NodeType) {
-	node[NODE_TYPE_OFFSET] = byte(nodeType)
-}
+	offset := leaf_node_allocate(node, uint32(len(cell)))
+	copy(node[offset:], cell)
 
-func leaf_node_num_cells(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[LEAF_NODE_NUM_CELLS_OFFSET]))
+	/* Shift the pointers after cellNum to make room */
+	pointers := node[LEAF_NODE_HEADER_SIZE:pointerArrayEnd]
+	copy(pointers[(cellNum+1)*LEAF_NODE_CELL_POINTER_SIZE:], pointers[cellNum*LEAF_NODE_CELL_POINTER_SIZE:])
+	set_leaf_node_cell_pointer(node, cellNum, uint16(offset))
+	set_leaf_node_num_cells(node, numCells+1)
 }
 
-func leaf_node_cell(node []byte, cellNum uint32) []byte {
-	offset := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_SIZE
-	return node[offset : offset+LEAF_NODE_CELL_SIZE]
-}
+/*
+ * Remove the pointer of a cell and give its space back to the node
+ */
+func leaf_node_remove_cell(node []byte, cellNum uint32) {
+	numCells := leaf_node_num_cells(node)
+	offset := uint32(leaf_node_cell_pointer(node, cellNum))
+	cellSize := uint32(len(leaf_node_cell(node, cellNum)))
 
-func leaf_node_cell_key(node []byte, cellNum uint32) *uint32 {
-	return (*uint32)(unsafe.Pointer(&(leaf_node_cell(node, cellNum)[LEAF_NODE_KEY_OFFSET])))
-}
+	pointers := node[LEAF_NODE_HEADER_SIZE : LEAF_NODE_HEADER_SIZE+numCells*LEAF_NODE_CELL_POINTER_SIZE]
+	copy(pointers[cellNum*LEAF_NODE_CELL_POINTER_SIZE:], pointers[(cellNum+1)*LEAF_NODE_CELL_POINTER_SIZE:])
+	set_leaf_node_num_cells(node, numCells-1)
 
-func leaf_node_cell_value(node []byte, cellNum uint32) []byte {
-	return leaf_node_cell(node, cellNum)[LEAF_NODE_VALUE_OFFSET : LEAF_NODE_VALUE_OFFSET+LEAF_NODE_VALUE_SIZE]
+	leaf_node_free_space_at(node, offset, cellSize)
 }
 
 func initialize_leaf_node(node []byte) {
 	set_node_type(node, NODE_LEAF)
 	set_node_root(node, false)
-	*leaf_node_num_cells(node) = 0
-	*leaf_node_next_leaf(node) = 0 // 0 represents no sibling
+	set_leaf_node_num_cells(node, 0)
+	set_leaf_node_next_leaf(node, 0) // 0 represents no sibling
+	set_leaf_node_cell_content_start(node, PAGE_USABLE_SIZE)
+	set_leaf_node_first_freeblock(node, 0)
+	set_leaf_node_fragmented_bytes(node, 0)
 }
 
 func initialize_internal_node(node []byte) {
 	set_node_type(node, NODE_INTERNAL)
 	set_node_root(node, false)
-	*internal_node_num_keys(node) = 0
+	set_internal_node_num_keys(node, 0)
 }
 
-func leaf_node_insert(cursor *Cursor, key uint32, row *Row) {
+func leaf_node_insert(cursor *Cursor, key []byte, row *Row) {
+	cell := leaf_node_build_cell(cursor.table.pager, key, serialize_row(row))
 	node := get_page(cursor.table.pager, cursor.pageNum)
-	numCells := *leaf_node_num_cells(node)
 
-	if numCells >= LEAF_NODE_MAX_CELLS {
-		leaf_node_split_and_insert(cursor, row)
+	if leaf_node_free_space(node) < uint32(len(cell))+LEAF_NODE_CELL_POINTER_SIZE {
+		leaf_node_split_and_insert(cursor, cell)
 		return
 	}
+	pager_mark_dirty(cursor.table.pager, cursor.pageNum)
+	leaf_node_insert_cell(node, cursor.cellNum, cell)
+}
 
-	if cursor.cellNum < numCells {
-		// Make room for new cell
-		for i := numCells; i > cursor.cellNum; i-- {
-			copy(leaf_node_cell(node, i), leaf_node_cell(node, i-1))
-		}
-	}
-	// Insert the row
-	*leaf_node_num_cells(node) += 1
-	*leaf_node_cell_key(node, cursor.cellNum) = key
-	copy(leaf_node_cell_value(node, cursor.cellNum), serialize_row(row))
+func leaf_node_delete(cursor *Cursor) {
+	node := get_page(cursor.table.pager, cursor.pageNum)
+	pager_mark_dirty(cursor.table.pager, cursor.pageNum)
+
+	free_overflow_chain(cursor.table.pager, leaf_node_cell(node, cursor.cellNum))
+	leaf_node_remove_cell(node, cursor.cellNum)
+
+	btree_rebalance(cursor.table, cursor.pageNum)
 }
 
-func leaf_node_find(table *Table, pageNum uint32, key uint32) *Cursor {
+func leaf_node_find(table *Table, pageNum uint32, key []byte) *Cursor {
 	node := get_page(table.pager, pageNum)
-	numCells := *leaf_node_num_cells(node)
+	numCells := leaf_node_num_cells(node)
 
 	cursor := &Cursor{}
 	cursor.table = table
 	cursor.pageNum = pageNum
+	pager_pin(table.pager, pageNum)
 
 	// binary search
 	minIndex := uint32(0)
 	onePastMaxIndex := numCells
 	for onePastMaxIndex != minIndex {
 		index := (minIndex + onePastMaxIndex) / 2
-		keyAtIndex := *leaf_node_cell_key(node, index)
-		if key == keyAtIndex {
+		result := table.compareKeys(key, leaf_node_cell_key(node, index))
+		if result == 0 {
 			cursor.cellNum = index
 			return cursor
 		}
-		if key < keyAtIndex {
+		if result < 0 {
 			onePastMaxIndex = index
 		} else {
 			minIndex = index + 1
@@ -591,19 +4590,19 @@ func leaf_node_find(table *Table, pageNum uint32, key uint32) *Cursor {
 	return cursor
 }
 
-func internal_node_find_child(node []byte, key uint32) uint32 {
+func internal_node_find_child(table *Table, node []byte, key []byte) uint32 {
 	/*
 	 * Return the index of the child which should contain the given key
 	 */
-	numKeys := *internal_node_num_keys(node)
+	numKeys := internal_node_num_keys(node)
 	/* Binary search to find the index of child to search */
 	minIndex := uint32(0)
 	maxIndex := numKeys
 
 	for minIndex != maxIndex {
 		index := (minIndex + maxIndex) / 2
-		keyToRight := *internal_node_cell_key(node, index)
-		if keyToRight >= key {
+		keyToRight := internal_node_cell_key(node, index)
+		if table.compareKeys(keyToRight, key) >= 0 {
 			maxIndex = index
 		} else {
 			minIndex = index + 1
@@ -612,11 +4611,11 @@ func internal_node_find_child(node []byte, key uint32) uint32 {
 	return minIndex
 }
 
-func internal_node_find(table *Table, pageNum uint32, key uint32) *Cursor {
+func internal_node_find(table *Table, pageNum uint32, key []byte) *Cursor {
 	node := get_page(table.pager, pageNum)
 
-	childIndex := internal_node_find_child(node, key)
-	childNum := *internal_node_child(node, childIndex)
+	childIndex := internal_node_find_child(table, node, key)
+	childNum := internal_node_child(node, childIndex)
 	child := get_page(table.pager, childNum)
 	switch get_node_type(child) {
 	case NODE_LEAF:
@@ -627,63 +4626,114 @@ func internal_node_find(table *Table, pageNum uint32, key uint32) *Cursor {
 	return nil
 }
 
-func leaf_node_split_and_insert(cursor *Cursor, value *Row) {
+func leaf_node_split_and_insert(cursor *Cursor, cell []byte) {
 	/*
-		Create a new node and move half the cells over.
-		Insert the new value in one of the two nodes.
+		Create a new node and move about half of the bytes over.
+		Insert the new cell in one of the two nodes.
 		Update parent or create a new parent
 	*/
 	oldNode := get_page(cursor.table.pager, cursor.pageNum)
-	oldMax := get_node_max_key(oldNode)
+	pager_mark_dirty(cursor.table.pager, cursor.pageNum)
+	oldMax := get_node_max_key(cursor.table.pager, oldNode)
 	newPageNum := get_unused_page_num(cursor.table.pager)
 	newNode := get_page(cursor.table.pager, newPageNum)
+	pager_mark_dirty(cursor.table.pager, newPageNum)
 	initialize_leaf_node(newNode)
-	*node_parent(newNode) = *node_parent(oldNode)
-	*leaf_node_next_leaf(newNode) = *leaf_node_next_leaf(oldNode)
-	*leaf_node_next_leaf(oldNode) = newPageNum
+	set_node_parent(newNode, node_parent(oldNode))
+	set_leaf_node_next_leaf(newNode, leaf_node_next_leaf(oldNode))
+	set_leaf_node_next_leaf(oldNode, newPageNum)
 
 	/*
-		All existing keys plus new key should be divided
-		evenly between old (left) and new (right) nodes.
-		Starting from the right, move each key to correct position.
+		All existing cells plus the new cell should be divided
+		between old (left) and new (right) nodes, with about
+		the same number of bytes on each side.
 	*/
-	for i := int(LEAF_NODE_MAX_CELLS); i >= 0; i-- {
-		var destNode []byte
-		if i >= LEAF_NODE_LEFT_SPLIT_COUNT {
-			destNode = newNode
-		} else {
-			destNode = oldNode
-		}
-		destCellIndex := uint32(i % LEAF_NODE_LEFT_SPLIT_COUNT)
-		destCell := leaf_node_cell(destNode, destCellIndex)
-
-		if i == int(cursor.cellNum) {
-			*leaf_node_cell_key(destNode, destCellIndex) = value.id
-			copy(leaf_node_cell_value(destNode, destCellIndex), serialize_row(value))
-		} else if i > int(cursor.cellNum) {
-			copy(destCell, leaf_node_cell(oldNode, uint32(i-1)))
-		} else {
-			copy(destCell, leaf_node_cell(oldNode, uint32(i)))
-		}
-	}
-
-	/* Update cell count on both leaf nodes */
-	*leaf_node_num_cells(oldNode) = LEAF_NODE_LEFT_SPLIT_COUNT
-	*leaf_node_num_cells(newNode) = LEAF_NODE_RIGHT_SPLIT_COUNT
+	oldCells := leaf_node_cells(oldNode)
+	cells := make([][]byte, 0, len(oldCells)+1)
+	cells = append(cells, oldCells[:cursor.cellNum]...)
+	cells = append(cells, cell)
+	cells = append(cells, oldCells[cursor.cellNum:]...)
+	splitIndex := leaf_node_split_point(cells)
+	leaf_node_set_cells(oldNode, cells[:splitIndex])
+	leaf_node_set_cells(newNode, cells[splitIndex:])
 
 	if is_node_root(oldNode) {
 		create_new_root(cursor.table, newPageNum)
 	} else {
-		parentPageNum := *node_parent(oldNode)
-		newMax := get_node_max_key(oldNode)
+		parentPageNum := node_parent(oldNode)
+		newMax := get_node_max_key(cursor.table.pager, oldNode)
 		parent := get_page(cursor.table.pager, parentPageNum)
-		update_internal_node_key(parent, oldMax, newMax)
+		pager_mark_dirty(cursor.table.pager, parentPageNum)
+		update_internal_node_key(cursor.table, parent, oldMax, newMax)
 		internal_node_insert(cursor.table, parentPageNum, newPageNum)
 	}
 }
 
-func leaf_node_next_leaf(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[LEAF_NODE_NEXT_LEAF_OFFSET]))
+/*
+ * Return the number of cells that stay in the left node of a split,
+ * dividing the bytes of the cells as evenly as possible
+ */
+func leaf_node_split_point(cells [][]byte) int {
+	totalSize := 0
+	for _, cell := range cells {
+		totalSize += len(cell) + LEAF_NODE_CELL_POINTER_SIZE
+	}
+
+	splitIndex := 1
+	bestDifference := totalSize
+	leftSize := 0
+	for i := 0; i+1 < len(cells); i++ {
+		leftSize += len(cells[i]) + LEAF_NODE_CELL_POINTER_SIZE
+		difference := totalSize - 2*leftSize
+		if difference < 0 {
+			difference = -difference
+		}
+		if difference < bestDifference {
+			bestDifference = difference
+			splitIndex = i + 1
+		}
+	}
+	return splitIndex
+}
+
+/*
+ * Return the page num of the leaf before the given one, 0 for the first leaf.
+ * Leaves only link to the next leaf, so climb to the nearest ancestor with
+ * a child to the left of the path and descend to the rightmost leaf of that child.
+ */
+func leaf_node_prev_leaf(pager *Pager, pageNum uint32) uint32 {
+	node := get_page(pager, pageNum)
+	for !is_node_root(node) {
+		parentPageNum := node_parent(node)
+		parent := get_page(pager, parentPageNum)
+		index := internal_node_child_index(parent, pageNum)
+		if index > 0 {
+			return node_rightmost_leaf(pager, internal_node_child(parent, index-1))
+		}
+		pageNum = parentPageNum
+		node = parent
+	}
+	return 0
+}
+
+/*
+ * Follow the right children down to the rightmost leaf of the subtree
+ */
+func node_rightmost_leaf(pager *Pager, pageNum uint32) uint32 {
+	node := get_page(pager, pageNum)
+	for get_node_type(node) == NODE_INTERNAL {
+		pageNum = internal_node_right_child(node)
+		node = get_page(pager, pageNum)
+	}
+	return pageNum
+}
+
+func leaf_node_next_leaf(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[LEAF_NODE_NEXT_LEAF_OFFSET:])
+}
+
+func set_leaf_node_next_leaf(node []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[LEAF_NODE_NEXT_LEAF_OFFSET:], pageNum)
 }
 
 func create_new_root(table *Table, rightChildPageNum uint32) {
@@ -695,46 +4745,74 @@ func create_new_root(table *Table, rightChildPageNum uint32) {
 		New root node points to two children.
 	*/
 	root := get_page(table.pager, table.rootPageNum)
+	pager_mark_dirty(table.pager, table.rootPageNum)
+	rightChild := get_page(table.pager, rightChildPageNum)
+	pager_mark_dirty(table.pager, rightChildPageNum)
 	leftChildPageNum := get_unused_page_num(table.pager)
 	leftChildPage := get_page(table.pager, leftChildPageNum)
+	pager_mark_dirty(table.pager, leftChildPageNum)
 
 	/* Left child has data copied from old root */
 	copy(leftChildPage, root)
 	set_node_root(leftChildPage, false)
 
+	/* Children of an internal left child must point at its new page */
+	if get_node_type(leftChildPage) == NODE_INTERNAL {
+		for i := uint32(0); i <= internal_node_num_keys(leftChildPage); i++ {
+			childPageNum := internal_node_child(leftChildPage, i)
+			child := get_page(table.pager, childPageNum)
+			pager_mark_dirty(table.pager, childPageNum)
+			set_node_parent(child, leftChildPageNum)
+		}
+	}
+
 	/* Root node is a new internal node with one key and two children */
 	initialize_internal_node(root)
 	set_node_root(root, true)
-	*internal_node_num_keys(root) = 1
-	*internal_node_child(root, 0) = leftChildPageNum
-	leftChildMaxKey := get_node_max_key(leftChildPage)
-	*internal_node_cell_key(root, 0) = leftChildMaxKey
-	*internal_node_right_child(root) = rightChildPageNum
+	set_internal_node_num_keys(root, 1)
+	set_internal_node_child(root, 0, leftChildPageNum)
+	leftChildMaxKey := get_node_max_key(table.pager, leftChildPage)
+	set_internal_node_cell_key(root, 0, leftChildMaxKey)
+	set_internal_node_right_child(root, rightChildPageNum)
+	set_node_parent(leftChildPage, table.rootPageNum)
+	set_node_parent(rightChild, table.rootPageNum)
+}
+
+func internal_node_num_keys(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:])
 }
 
-func internal_node_num_keys(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[INTERNAL_NODE_NUM_KEYS_OFFSET]))
+func set_internal_node_num_keys(node []byte, numKeys uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_NUM_KEYS_OFFSET:], numKeys)
 }
 
 /*
  * Return the page num of the right most child
  */
-func internal_node_right_child(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[INTERNAL_NODE_RIGHT_CHILD_OFFSET]))
+func internal_node_right_child(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:])
+}
+
+func set_internal_node_right_child(node []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_RIGHT_CHILD_OFFSET:], pageNum)
 }
 
 /*
  * Return the page num based on the cell num
  */
-func internal_node_cell_value(node []byte, cellNum uint32) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[INTERNAL_NODE_HEADER_SIZE+cellNum*INTERNAL_NODE_CELL_SIZE]))
+func internal_node_cell_value(node []byte, cellNum uint32) uint32 {
+	return binary.LittleEndian.Uint32(node[INTERNAL_NODE_HEADER_SIZE+cellNum*INTERNAL_NODE_CELL_SIZE:])
+}
+
+func set_internal_node_cell_value(node []byte, cellNum uint32, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[INTERNAL_NODE_HEADER_SIZE+cellNum*INTERNAL_NODE_CELL_SIZE:], pageNum)
 }
 
 /*
  * Return the page num based on the chlid num
  */
-func internal_node_child(node []byte, childNum uint32) *uint32 {
-	numKeys := *internal_node_num_keys(node)
+func internal_node_child(node []byte, childNum uint32) uint32 {
+	numKeys := internal_node_num_keys(node)
 	if childNum > numKeys {
 		fmt.Printf("Tried to access childNum %d > numKeys %d\n", childNum, numKeys)
 		os.Exit(1)
@@ -743,7 +4821,19 @@ func internal_node_child(node []byte, childNum uint32) *uint32 {
 	} else {
 		return internal_node_cell_value(node, childNum)
 	}
-	return nil
+	return 0
+}
+
+func set_internal_node_child(node []byte, childNum uint32, pageNum uint32) {
+	numKeys := internal_node_num_keys(node)
+	if childNum > numKeys {
+		fmt.Printf("Tried to access childNum %d > numKeys %d\n", childNum, numKeys)
+		os.Exit(1)
+	} else if childNum == numKeys {
+		set_internal_node_right_child(node, pageNum)
+	} else {
+		set_internal_node_cell_value(node, childNum, pageNum)
+	}
 }
 
 func internal_node_cell(node []byte, cellNum uint32) []byte {
@@ -751,21 +4841,40 @@ func internal_node_cell(node []byte, cellNum uint32) []byte {
 	return node[offset : offset+INTERNAL_NODE_CELL_SIZE]
 }
 
-func internal_node_cell_key(node []byte, keyNum uint32) *uint32 {
+func internal_node_key_size(node []byte, keyNum uint32) uint16 {
+	offset := INTERNAL_NODE_HEADER_SIZE + keyNum*INTERNAL_NODE_CELL_SIZE + INTENRAL_NODE_CHILD_SIZE
+	return binary.LittleEndian.Uint16(node[offset:])
+}
+
+func set_internal_node_key_size(node []byte, keyNum uint32, keySize uint16) {
 	offset := INTERNAL_NODE_HEADER_SIZE + keyNum*INTERNAL_NODE_CELL_SIZE + INTENRAL_NODE_CHILD_SIZE
-	return (*uint32)(unsafe.Pointer(&node[offset]))
+	binary.LittleEndian.PutUint16(node[offset:], keySize)
 }
 
-func get_node_max_key(node []byte) uint32 {
+func internal_node_cell_key(node []byte, keyNum uint32) []byte {
+	offset := INTERNAL_NODE_HEADER_SIZE + keyNum*INTERNAL_NODE_CELL_SIZE + INTENRAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE_SIZE
+	return node[offset : offset+uint32(internal_node_key_size(node, keyNum))]
+}
+
+func set_internal_node_cell_key(node []byte, keyNum uint32, key []byte) {
+	set_internal_node_key_size(node, keyNum, uint16(len(key)))
+	copy(internal_node_cell_key(node, keyNum), key)
+}
+
+/*
+ * Return a copy of the largest key stored in the subtree rooted at node
+ */
+func get_node_max_key(pager *Pager, node []byte) []byte {
 	switch get_node_type(node) {
 	case (NODE_INTERNAL):
-		return *internal_node_cell_key(node, *internal_node_num_keys(node)-1)
+		rightChild := get_page(pager, internal_node_right_child(node))
+		return get_node_max_key(pager, rightChild)
 	case (NODE_LEAF):
-		return *leaf_node_cell_key(node, *leaf_node_num_cells(node)-1)
+		return append([]byte(nil), leaf_node_cell_key(node, leaf_node_num_cells(node)-1)...)
 	default:
 		fmt.Printf("The node type isn't supported\n")
 		os.Exit(1)
-		return 0
+		return nil
 	}
 }
 
@@ -782,13 +4891,20 @@ func set_node_root(node []byte, isRoot bool) {
 	}
 }
 
-func node_parent(node []byte) *uint32 {
-	return (*uint32)(unsafe.Pointer(&node[PARENT_POINTER_OFFSET]))
+func node_parent(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[PARENT_POINTER_OFFSET:])
+}
+
+func set_node_parent(node []byte, pageNum uint32) {
+	binary.LittleEndian.PutUint32(node[PARENT_POINTER_OFFSET:], pageNum)
 }
 
-func update_internal_node_key(node []byte, oldKey uint32, newKey uint32) {
-	oldChildIndex := internal_node_find_child(node, oldKey)
-	*internal_node_cell_key(node, oldChildIndex) = newKey
+func update_internal_node_key(table *Table, node []byte, oldKey []byte, newKey []byte) {
+	oldChildIndex := internal_node_find_child(table, node, oldKey)
+	if oldChildIndex < internal_node_num_keys(node) {
+		// The right child has no key of its own
+		set_internal_node_cell_key(node, oldChildIndex, newKey)
+	}
 }
 
 func internal_node_insert(table *Table, parentPageNum uint32, childPageNum uint32) {
@@ -798,25 +4914,30 @@ func internal_node_insert(table *Table, parentPageNum uint32, childPageNum uint3
 
 	parent := get_page(table.pager, parentPageNum)
 	child := get_page(table.pager, childPageNum)
-	childMaxKey := get_node_max_key(child)
-	index := internal_node_find_child(parent, childMaxKey)
+	childMaxKey := get_node_max_key(table.pager, child)
+	index := internal_node_find_child(table, parent, childMaxKey)
 
-	originalNumKeys := *internal_node_num_keys(parent)
-	*internal_node_num_keys(parent) = originalNumKeys + 1
+	originalNumKeys := internal_node_num_keys(parent)
 
 	if originalNumKeys >= INTERNAL_NODE_MAX_CELLS {
-		fmt.Printf("Need to implement splitting internal node\n")
-		os.Exit(1)
+		internal_node_split_and_insert(table, parentPageNum, childPageNum)
+		return
 	}
 
-	rightChildPageNum := *internal_node_right_child(parent)
+	pager_mark_dirty(table.pager, parentPageNum)
+	pager_mark_dirty(table.pager, childPageNum)
+	set_internal_node_num_keys(parent, originalNumKeys+1)
+	set_node_parent(child, parentPageNum)
+
+	rightChildPageNum := internal_node_right_child(parent)
 	rightChild := get_page(table.pager, rightChildPageNum)
+	rightChildMaxKey := get_node_max_key(table.pager, rightChild)
 
-	if childMaxKey > get_node_max_key(rightChild) {
+	if table.compareKeys(childMaxKey, rightChildMaxKey) > 0 {
 		/* Replace the right child */
-		*internal_node_child(parent, originalNumKeys) = rightChildPageNum
-		*internal_node_cell_key(parent, originalNumKeys) = get_node_max_key(rightChild)
-		*internal_node_right_child(parent) = childPageNum
+		set_internal_node_child(parent, originalNumKeys, rightChildPageNum)
+		set_internal_node_cell_key(parent, originalNumKeys, rightChildMaxKey)
+		set_internal_node_right_child(parent, childPageNum)
 	} else {
 		/* Make room for the new cell */
 		for i := originalNumKeys; i > index; i-- {
@@ -824,7 +4945,355 @@ func internal_node_insert(table *Table, parentPageNum uint32, childPageNum uint3
 			src := internal_node_cell(parent, i-1)
 			copy(dest, src)
 		}
-		*internal_node_child(parent, index) = childPageNum
-		*internal_node_cell_key(parent, index) = childMaxKey
+		set_internal_node_child(parent, index, childPageNum)
+		set_internal_node_cell_key(parent, index, childMaxKey)
+	}
+}
+
+func internal_node_split_and_insert(table *Table, oldPageNum uint32, childPageNum uint32) {
+	/*
+		Split a full internal node while adding a new child to it.
+		The children (old ones plus the new one) are divided between
+		the old (left) node and a new (right) node, then the new node
+		is inserted into the parent, which may split in turn.
+		Splitting the root grows the tree by one level.
+	*/
+	pager := table.pager
+	oldNode := get_page(pager, oldPageNum)
+	oldMax := get_node_max_key(pager, oldNode)
+	child := get_page(pager, childPageNum)
+	childMax := get_node_max_key(pager, child)
+
+	/* Collect all children in key order, including the new one */
+	numKeys := internal_node_num_keys(oldNode)
+	children := make([]uint32, 0, numKeys+2)
+	maxKeys := make([][]byte, 0, numKeys+2)
+	inserted := false
+	for i := uint32(0); i <= numKeys; i++ {
+		pageNum := internal_node_child(oldNode, i)
+		var maxKey []byte
+		if i < numKeys {
+			maxKey = append([]byte(nil), internal_node_cell_key(oldNode, i)...)
+		} else {
+			maxKey = get_node_max_key(pager, get_page(pager, pageNum))
+		}
+		if !inserted && table.compareKeys(childMax, maxKey) < 0 {
+			children = append(children, childPageNum)
+			maxKeys = append(maxKeys, childMax)
+			inserted = true
+		}
+		children = append(children, pageNum)
+		maxKeys = append(maxKeys, maxKey)
+	}
+	if !inserted {
+		children = append(children, childPageNum)
+		maxKeys = append(maxKeys, childMax)
+	}
+
+	pager_mark_dirty(pager, oldPageNum)
+	newPageNum := get_unused_page_num(pager)
+	newNode := get_page(pager, newPageNum)
+	pager_mark_dirty(pager, newPageNum)
+	initialize_internal_node(newNode)
+
+	/* The left node keeps the first half of the children */
+	leftCount := uint32(len(children)+1) / 2
+	internal_node_fill(pager, oldNode, oldPageNum, children[:leftCount], maxKeys[:leftCount])
+	internal_node_fill(pager, newNode, newPageNum, children[leftCount:], maxKeys[leftCount:])
+
+	if is_node_root(oldNode) {
+		create_new_root(table, newPageNum)
+		return
+	}
+
+	parentPageNum := node_parent(oldNode)
+	parent := get_page(pager, parentPageNum)
+	pager_mark_dirty(pager, parentPageNum)
+	update_internal_node_key(table, parent, oldMax, get_node_max_key(pager, oldNode))
+	internal_node_insert(table, parentPageNum, newPageNum)
+}
+
+/*
+ * Overwrite the cells of an internal node with the given children.
+ * maxKeys[i] is the max key of children[i]; the last child becomes the right child.
+ */
+func internal_node_fill(pager *Pager, node []byte, pageNum uint32, children []uint32, maxKeys [][]byte) {
+	numKeys := uint32(len(children) - 1)
+	set_internal_node_num_keys(node, numKeys)
+	for i := uint32(0); i < numKeys; i++ {
+		set_internal_node_cell_value(node, i, children[i])
+		set_internal_node_cell_key(node, i, maxKeys[i])
+	}
+	set_internal_node_right_child(node, children[numKeys])
+
+	for _, childPageNum := range children {
+		child := get_page(pager, childPageNum)
+		pager_mark_dirty(pager, childPageNum)
+		set_node_parent(child, pageNum)
+	}
+}
+
+/*
+ * Return the index of the child with the given page num
+ */
+func internal_node_child_index(node []byte, childPageNum uint32) uint32 {
+	numKeys := internal_node_num_keys(node)
+	for i := uint32(0); i < numKeys; i++ {
+		if internal_node_cell_value(node, i) == childPageNum {
+			return i
+		}
+	}
+	if internal_node_right_child(node) != childPageNum {
+		fmt.Printf("Page %d is not a child of its parent\n", childPageNum)
+		os.Exit(1)
+	}
+	return numKeys
+}
+
+/*
+ * Remove the key/child pair at the given cell num
+ */
+func internal_node_remove_cell(node []byte, cellNum uint32) {
+	numKeys := internal_node_num_keys(node)
+	for i := cellNum; i+1 < numKeys; i++ {
+		copy(internal_node_cell(node, i), internal_node_cell(node, i+1))
+	}
+	set_internal_node_num_keys(node, numKeys-1)
+}
+
+func node_is_underflow(node []byte) bool {
+	if get_node_type(node) == NODE_LEAF {
+		return leaf_node_used_space(node) < LEAF_NODE_MIN_USED_SPACE
+	}
+	return internal_node_num_keys(node) < INTERNAL_NODE_MIN_CELLS
+}
+
+/*
+ * Return whether all entries of two siblings fit in a single node
+ */
+func nodes_can_merge(left []byte, right []byte) bool {
+	if get_node_type(left) == NODE_LEAF {
+		return leaf_node_used_space(left)+leaf_node_used_space(right) <= LEAF_NODE_SPACE_FOR_CELLS
+	}
+	/* The right child of the left node needs a key of its own */
+	return internal_node_num_keys(left)+internal_node_num_keys(right)+1 <= INTERNAL_NODE_MAX_CELLS
+}
+
+/*
+ * Store the current max key of the node in the nearest ancestor
+ * that keeps a key for it. The right child has no key of its own,
+ * so its max is the max of its parent and the update moves up.
+ */
+func update_max_key_in_ancestors(table *Table, pageNum uint32) {
+	node := get_page(table.pager, pageNum)
+	maxKey := get_node_max_key(table.pager, node)
+
+	for !is_node_root(node) {
+		parentPageNum := node_parent(node)
+		parent := get_page(table.pager, parentPageNum)
+		index := internal_node_child_index(parent, pageNum)
+		if index < internal_node_num_keys(parent) {
+			pager_mark_dirty(table.pager, parentPageNum)
+			set_internal_node_cell_key(parent, index, maxKey)
+			return
+		}
+		pageNum = parentPageNum
+		node = parent
+	}
+}
+
+func btree_rebalance(table *Table, pageNum uint32) {
+	/*
+		Restore the tree invariants after an entry was removed from a node.
+		An underflowing node is merged with a sibling when their entries
+		fit in one node, and the parent, which lost an entry, is rebalanced
+		in turn. Otherwise the node borrows entries from the sibling.
+		A root left with a single child is collapsed into that child.
+	*/
+	pager := table.pager
+	node := get_page(pager, pageNum)
+
+	if is_node_root(node) {
+		if get_node_type(node) == NODE_INTERNAL && internal_node_num_keys(node) == 0 {
+			collapse_root(table)
+		}
+		return
+	}
+
+	if !node_is_underflow(node) {
+		update_max_key_in_ancestors(table, pageNum)
+		return
+	}
+
+	parentPageNum := node_parent(node)
+	parent := get_page(pager, parentPageNum)
+	index := internal_node_child_index(parent, pageNum)
+
+	/* Pair the node with its left sibling, or the right one for the first child */
+	var leftPageNum, rightPageNum uint32
+	if index > 0 {
+		leftPageNum = internal_node_child(parent, index-1)
+		rightPageNum = pageNum
+	} else {
+		leftPageNum = pageNum
+		rightPageNum = internal_node_child(parent, 1)
+	}
+
+	if nodes_can_merge(get_page(pager, leftPageNum), get_page(pager, rightPageNum)) {
+		merge_nodes(table, parentPageNum, leftPageNum, rightPageNum)
+		update_max_key_in_ancestors(table, leftPageNum)
+		btree_rebalance(table, parentPageNum)
+		return
+	}
+
+	if index > 0 {
+		borrow_from_left(table, leftPageNum, rightPageNum)
+	} else {
+		borrow_from_right(table, leftPageNum, rightPageNum)
+	}
+	update_max_key_in_ancestors(table, leftPageNum)
+	update_max_key_in_ancestors(table, rightPageNum)
+}
+
+/*
+ * Move entries from the end of the left node to the front of its right sibling
+ */
+func borrow_from_left(table *Table, leftPageNum uint32, rightPageNum uint32) {
+	left := get_page(table.pager, leftPageNum)
+	pager_mark_dirty(table.pager, leftPageNum)
+	right := get_page(table.pager, rightPageNum)
+	pager_mark_dirty(table.pager, rightPageNum)
+
+	if get_node_type(right) == NODE_LEAF {
+		/* Cells differ in size, so move as many as the right node needs */
+		for node_is_underflow(right) {
+			lastCellNum := leaf_node_num_cells(left) - 1
+			cell := append([]byte(nil), leaf_node_cell(left, lastCellNum)...)
+			leaf_node_remove_cell(left, lastCellNum)
+			leaf_node_insert_cell(right, 0, cell)
+		}
+		return
+	}
+
+	/* The right child of the left node becomes the first child of the right node */
+	movedPageNum := internal_node_right_child(left)
+	moved := get_page(table.pager, movedPageNum)
+	pager_mark_dirty(table.pager, movedPageNum)
+	rightNumKeys := internal_node_num_keys(right)
+	for i := rightNumKeys; i > 0; i-- {
+		copy(internal_node_cell(right, i), internal_node_cell(right, i-1))
+	}
+	set_internal_node_cell_value(right, 0, movedPageNum)
+	set_internal_node_cell_key(right, 0, get_node_max_key(table.pager, moved))
+	set_internal_node_num_keys(right, rightNumKeys+1)
+	set_node_parent(moved, rightPageNum)
+
+	leftNumKeys := internal_node_num_keys(left)
+	set_internal_node_right_child(left, internal_node_cell_value(left, leftNumKeys-1))
+	set_internal_node_num_keys(left, leftNumKeys-1)
+}
+
+/*
+ * Move entries from the front of the right node to the end of its left sibling
+ */
+func borrow_from_right(table *Table, leftPageNum uint32, rightPageNum uint32) {
+	left := get_page(table.pager, leftPageNum)
+	pager_mark_dirty(table.pager, leftPageNum)
+	right := get_page(table.pager, rightPageNum)
+	pager_mark_dirty(table.pager, rightPageNum)
+
+	if get_node_type(left) == NODE_LEAF {
+		/* Cells differ in size, so move as many as the left node needs */
+		for node_is_underflow(left) {
+			cell := append([]byte(nil), leaf_node_cell(right, 0)...)
+			leaf_node_remove_cell(right, 0)
+			leaf_node_insert_cell(left, leaf_node_num_cells(left), cell)
+		}
+		return
+	}
+
+	/* The first child of the right node becomes the right child of the left node */
+	leftNumKeys := internal_node_num_keys(left)
+	oldRightChildPageNum := internal_node_right_child(left)
+	set_internal_node_cell_value(left, leftNumKeys, oldRightChildPageNum)
+	set_internal_node_cell_key(left, leftNumKeys, get_node_max_key(table.pager, get_page(table.pager, oldRightChildPageNum)))
+	set_internal_node_num_keys(left, leftNumKeys+1)
+
+	movedPageNum := internal_node_cell_value(right, 0)
+	set_internal_node_right_child(left, movedPageNum)
+	moved := get_page(table.pager, movedPageNum)
+	pager_mark_dirty(table.pager, movedPageNum)
+	set_node_parent(moved, leftPageNum)
+	internal_node_remove_cell(right, 0)
+}
+
+/*
+ * Move every entry of the right node into its left sibling and
+ * remove the right node from the parent
+ */
+func merge_nodes(table *Table, parentPageNum uint32, leftPageNum uint32, rightPageNum uint32) {
+	left := get_page(table.pager, leftPageNum)
+	pager_mark_dirty(table.pager, leftPageNum)
+	right := get_page(table.pager, rightPageNum)
+
+	if get_node_type(left) == NODE_LEAF {
+		for _, cell := range leaf_node_cells(right) {
+			leaf_node_insert_cell(left, leaf_node_num_cells(left), cell)
+		}
+		set_leaf_node_next_leaf(left, leaf_node_next_leaf(right))
+	} else {
+		/* The old right child of the left node gets a key of its own */
+		leftNumKeys := internal_node_num_keys(left)
+		oldRightChildPageNum := internal_node_right_child(left)
+		set_internal_node_cell_value(left, leftNumKeys, oldRightChildPageNum)
+		set_internal_node_cell_key(left, leftNumKeys, get_node_max_key(table.pager, get_page(table.pager, oldRightChildPageNum)))
+		leftNumKeys++
+
+		rightNumKeys := internal_node_num_keys(right)
+		for i := uint32(0); i <= rightNumKeys; i++ {
+			childPageNum := internal_node_child(right, i)
+			if i < rightNumKeys {
+				copy(internal_node_cell(left, leftNumKeys+i), internal_node_cell(right, i))
+			} else {
+				set_internal_node_right_child(left, childPageNum)
+			}
+			child := get_page(table.pager, childPageNum)
+			pager_mark_dirty(table.pager, childPageNum)
+			set_node_parent(child, leftPageNum)
+		}
+		set_internal_node_num_keys(left, leftNumKeys+rightNumKeys)
+	}
+
+	/* The left node takes over the slot of the right node in the parent */
+	parent := get_page(table.pager, parentPageNum)
+	pager_mark_dirty(table.pager, parentPageNum)
+	index := internal_node_child_index(parent, leftPageNum)
+	internal_node_remove_cell(parent, index)
+	set_internal_node_child(parent, index, leftPageNum)
+
+	free_page(table.pager, rightPageNum)
+}
+
+/*
+ * Replace a root that has a single child with that child
+ */
+func collapse_root(table *Table) {
+	root := get_page(table.pager, table.rootPageNum)
+	pager_mark_dirty(table.pager, table.rootPageNum)
+	childPageNum := internal_node_right_child(root)
+	child := get_page(table.pager, childPageNum)
+
+	copy(root, child)
+	set_node_root(root, true)
+
+	if get_node_type(root) == NODE_INTERNAL {
+		for i := uint32(0); i <= internal_node_num_keys(root); i++ {
+			grandchildPageNum := internal_node_child(root, i)
+			grandchild := get_page(table.pager, grandchildPageNum)
+			pager_mark_dirty(table.pager, grandchildPageNum)
+			set_node_parent(grandchild, table.rootPageNum)
+		}
 	}
+
+	free_page(table.pager, childPageNum)
 }
@@ -1,11 +1,11 @@
 describe 'database' do
   before do
-    `rm -rf test.db`
+    `rm -rf test.db test.db-journal test.db-wal`
   end
 
-  def run_script(commands)
+  def run_script(commands, options = "")
     raw_output = nil
-    IO.popen("./main test.db", "r+") do |pipe|
+    IO.popen("./main #{options} test.db", "r+") do |pipe|
       commands.each do |command|
         begin
           pipe.puts command
@@ -38,22 +38,32 @@ describe 'database' do
     ])
   end
 
-  it 'prints error message when table is full' do
+  it 'allows inserting more rows than fit in the page cache' do
     script = (1..1401).map do |i|
       "insert #{i} user#{i} person#{i}@example.com"
     end
     script << ".exit"
-    result = run_script(script)
-    expect(result.last(3)).to match_array([
+    result = run_script(script, "-cache-size 10")
+    expect(result.last(2)).to match_array([
+      "db > Executed.",
       "db > ",
+    ])
+
+    result = run_script([
+      "select",
+      ".exit",
+    ], "-cache-size 10")
+    expect(result.length).to eq(1401 + 4)
+    expect(result.last(3)).to match_array([
+      "{1401 user1401 person1401@example.com}",
       "Executed.",
-      "db > Need to implement updating parent after split",
+      "db > ",
     ])
   end
 
-  it 'allows inserting strings that are the maximum length' do
-    long_username = "a"*32
-    long_email = "a"*255
+  it 'allows inserting long strings' do
+    long_username = "a"*33
+    long_email = "a"*256
     script = [
       "insert 1 #{long_username} #{long_email}",
       "select",
@@ -70,20 +80,48 @@ describe 'database' do
     ])
   end
 
-  it 'prints error message if strings are too long' do
-    long_username = "a"*33
-    long_email = "a"*256
-    script = [
-      "insert 1 #{long_username} #{long_email}",
+  it 'stores values larger than a page in overflow pages' do
+    long_email = "a"*10000
+    result = run_script([
+      "insert 1 user1 #{long_email}",
+      ".dbinfo",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > format version: 1",
+      "page size: 4096",
+      "page count: 5",
+      "root page: 1",
+      "freelist trunk page: 0",
+      "freelist page count: 0",
+      "schema cookie: 0",
+      "key type: int64",
+      "db > ",
+    ])
+
+    result = run_script([
       "select",
+      "delete 1",
+      ".dbinfo",
       ".exit",
-    ]
-    result = run_script(script)
+    ])
     expect(result).to match_array([
       "Simple SQLite",
       "---------------------",
-      "db > String is too long.",
+      "db > {1 user1 #{long_email}}",
+      "Executed.",
       "db > Executed.",
+      "db > format version: 1",
+      "page size: 4096",
+      "page count: 5",
+      "root page: 1",
+      "freelist trunk page: 4",
+      "freelist page count: 3",
+      "schema cookie: 0",
+      "key type: int64",
       "db > ",
     ])
   end
@@ -112,6 +150,94 @@ describe 'database' do
     ])
   end
 
+  it 'keeps data when input ends without .exit' do
+    result1 = run_script([
+      "insert 1 user1 person1@example.com",
+      "",
+      "begin",
+      "insert 2 user2 person2@example.com",
+    ])
+    expect(result1).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > db > Executed.",
+      "db > Executed.",
+      "db > ",
+    ])
+    result2 = run_script([
+      "select",
+      ".exit",
+    ])
+    expect(result2).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > {1 user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'closes the database when terminated' do
+    IO.popen("./main test.db", "r+") do |pipe|
+      pipe.puts "insert 1 user1 person1@example.com"
+      pipe.gets
+      pipe.gets
+      pipe.gets
+      Process.kill("TERM", pipe.pid)
+    end
+    expect($?.exitstatus).to eq(0)
+    expect(File.exist?("test.db-journal")).to be false
+    result = run_script([
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > {1 user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'keeps data written without waiting for the disk' do
+    ["off", "normal"].each_with_index do |synchronous, i|
+      run_script([
+        "insert #{i + 1} user#{i + 1} person#{i + 1}@example.com",
+        ".exit",
+      ], "-synchronous #{synchronous}")
+    end
+    result = run_script([
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > {1 user1 person1@example.com}",
+      "{2 user2 person2@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'only writes the pages a statement modified' do
+    run_script([
+      "insert 1 user1 person1@example.com",
+      "insert 2 user2 person2@example.com",
+      ".exit",
+    ])
+    result = run_script([
+      "update set email=new1@example.com where id=1",
+      ".stats",
+      ".exit",
+    ])
+    # The header page and the leaf holding row 1
+    expect(result).to include("pages written: 2")
+    expect(result).to include("journal pages written: 2")
+  end
+
   it 'prints constants' do
     script = [
       ".constants",
@@ -123,12 +249,16 @@ describe 'database' do
       "Simple SQLite",
       "---------------------",
       "db > Constants:",
-      "ROW_SIZE: 291",
+      "PAGE_SIZE: 4096",
+      "PAGE_USABLE_SIZE: 4092",
       "COMMON_NODE_HEADER_SIZE: 6",
-      "LEAF_NODE_HEADER_SIZE: 14",
-      "LEAF_NODE_CELL_SIZE: 295",
-      "LEAF_NODE_SPACE_FOR_CELLS: 4082",
-      "LEAF_NODE_MAX_CELLS: 13",
+      "LEAF_NODE_HEADER_SIZE: 22",
+      "LEAF_NODE_CELL_HEADER_SIZE: 6",
+      "LEAF_NODE_SPACE_FOR_CELLS: 4070",
+      "LEAF_NODE_MAX_LOCAL_PAYLOAD: 941",
+      "OVERFLOW_PAGE_DATA_SIZE: 4088",
+      "MAX_KEY_SIZE: 64",
+      "INTERNAL_NODE_MAX_CELLS: 58",
       "db > ",
     ])
   end
@@ -182,21 +312,23 @@ describe 'database' do
     script << ".btree"
     script << "insert 15 user15 person15@example.com"
     script << ".exit"
-    result = run_script(script)
+    result = run_script(script, "-page-size 512")
 
     expect(result[14...(result.length)]).to match_array([
+      "db > Executed.",
+      "db > Executed.",
       "db > Tree:",
       "- internal (size 1)",
-      "  - leaf (size 7)",
+      "  - leaf (size 6)",
       "    - 1",
       "    - 2",
       "    - 3",
       "    - 4",
       "    - 5",
       "    - 6",
+      "  - key 6",
+      "  - leaf (size 8)",
       "    - 7",
-      "  - key 7",
-      "  - leaf (size 7)",
       "    - 8",
       "    - 9",
       "    - 10",
@@ -205,8 +337,6 @@ describe 'database' do
       "    - 13",
       "    - 14",
       "db > Executed.",
-      "db > Executed.",
-      "db > Executed.",
       "db > ",
     ])
   end
@@ -218,7 +348,7 @@ describe 'database' do
     end
     script << "select"
     script << ".exit"
-    result = run_script(script)
+    result = run_script(script, "-page-size 512")
 
     expect(result[15...result.length]).to match_array([
       "db > {1 user1 person1@example.com}",
@@ -243,7 +373,7 @@ describe 'database' do
     ])
   end
 
-  it 'allows printing out the structure of a 4-leaf-node btree' do
+  it 'allows printing out the structure of a 5-leaf-node btree' do
     script = [
       "insert 18 user18 person18@example.com",
       "insert 7 user7 person7@example.com",
@@ -278,6 +408,1042 @@ describe 'database' do
       ".btree",
       ".exit",
     ]
-    result = run_script(script)
+    result = run_script(script, "-page-size 512")
+
+    expect(result[32...(result.length)]).to match_array([
+      "db > Tree:",
+      "- internal (size 4)",
+      "  - leaf (size 7)",
+      "    - 1",
+      "    - 2",
+      "    - 3",
+      "    - 4",
+      "    - 5",
+      "    - 6",
+      "    - 7",
+      "  - key 7",
+      "  - leaf (size 6)",
+      "    - 8",
+      "    - 9",
+      "    - 10",
+      "    - 11",
+      "    - 12",
+      "    - 13",
+      "  - key 13",
+      "  - leaf (size 5)",
+      "    - 14",
+      "    - 15",
+      "    - 16",
+      "    - 17",
+      "    - 18",
+      "  - key 18",
+      "  - leaf (size 5)",
+      "    - 19",
+      "    - 20",
+      "    - 21",
+      "    - 22",
+      "    - 23",
+      "  - key 23",
+      "  - leaf (size 7)",
+      "    - 24",
+      "    - 25",
+      "    - 26",
+      "    - 27",
+      "    - 28",
+      "    - 29",
+      "    - 30",
+      "db > ",
+    ])
+  end
+
+  it 'allows printing out the structure of a 10-leaf-node btree' do
+    script = [
+      "insert 58 user58 person58@example.com",
+      "insert 56 user56 person56@example.com",
+      "insert 8 user8 person8@example.com",
+      "insert 54 user54 person54@example.com",
+      "insert 77 user77 person77@example.com",
+      "insert 7 user7 person7@example.com",
+      "insert 25 user25 person25@example.com",
+      "insert 71 user71 person71@example.com",
+      "insert 13 user13 person13@example.com",
+      "insert 22 user22 person22@example.com",
+      "insert 53 user53 person53@example.com",
+      "insert 51 user51 person51@example.com",
+      "insert 59 user59 person59@example.com",
+      "insert 32 user32 person32@example.com",
+      "insert 36 user36 person36@example.com",
+      "insert 79 user79 person79@example.com",
+      "insert 10 user10 person10@example.com",
+      "insert 33 user33 person33@example.com",
+      "insert 20 user20 person20@example.com",
+      "insert 4 user4 person4@example.com",
+      "insert 35 user35 person35@example.com",
+      "insert 76 user76 person76@example.com",
+      "insert 49 user49 person49@example.com",
+      "insert 24 user24 person24@example.com",
+      "insert 70 user70 person70@example.com",
+      "insert 48 user48 person48@example.com",
+      "insert 39 user39 person39@example.com",
+      "insert 15 user15 person15@example.com",
+      "insert 47 user47 person47@example.com",
+      "insert 30 user30 person30@example.com",
+      "insert 86 user86 person86@example.com",
+      "insert 31 user31 person31@example.com",
+      "insert 68 user68 person68@example.com",
+      "insert 37 user37 person37@example.com",
+      "insert 66 user66 person66@example.com",
+      "insert 63 user63 person63@example.com",
+      "insert 40 user40 person40@example.com",
+      "insert 78 user78 person78@example.com",
+      "insert 19 user19 person19@example.com",
+      "insert 46 user46 person46@example.com",
+      "insert 14 user14 person14@example.com",
+      "insert 81 user81 person81@example.com",
+      "insert 72 user72 person72@example.com",
+      "insert 6 user6 person6@example.com",
+      "insert 50 user50 person50@example.com",
+      "insert 85 user85 person85@example.com",
+      "insert 67 user67 person67@example.com",
+      "insert 2 user2 person2@example.com",
+      "insert 55 user55 person55@example.com",
+      "insert 69 user69 person69@example.com",
+      "insert 5 user5 person5@example.com",
+      "insert 65 user65 person65@example.com",
+      "insert 52 user52 person52@example.com",
+      "insert 1 user1 person1@example.com",
+      "insert 29 user29 person29@example.com",
+      "insert 9 user9 person9@example.com",
+      "insert 43 user43 person43@example.com",
+      "insert 75 user75 person75@example.com",
+      "insert 21 user21 person21@example.com",
+      "insert 82 user82 person82@example.com",
+      "insert 12 user12 person12@example.com",
+      "insert 18 user18 person18@example.com",
+      "insert 60 user60 person60@example.com",
+      "insert 44 user44 person44@example.com",
+      ".btree",
+      ".exit",
+    ]
+    result = run_script(script, "-page-size 512")
+
+    expect(result[66...(result.length)]).to match_array([
+      "db > Tree:",
+      "- internal (size 1)",
+      "  - internal (size 4)",
+      "    - leaf (size 6)",
+      "      - 1",
+      "      - 2",
+      "      - 4",
+      "      - 5",
+      "      - 6",
+      "      - 7",
+      "    - key 7",
+      "    - leaf (size 7)",
+      "      - 8",
+      "      - 9",
+      "      - 10",
+      "      - 12",
+      "      - 13",
+      "      - 14",
+      "      - 15",
+      "    - key 15",
+      "    - leaf (size 7)",
+      "      - 18",
+      "      - 19",
+      "      - 20",
+      "      - 21",
+      "      - 22",
+      "      - 24",
+      "      - 25",
+      "    - key 25",
+      "    - leaf (size 7)",
+      "      - 29",
+      "      - 30",
+      "      - 31",
+      "      - 32",
+      "      - 33",
+      "      - 35",
+      "      - 36",
+      "    - key 36",
+      "    - leaf (size 7)",
+      "      - 37",
+      "      - 39",
+      "      - 40",
+      "      - 43",
+      "      - 44",
+      "      - 46",
+      "      - 47",
+      "  - key 47",
+      "  - internal (size 4)",
+      "    - leaf (size 6)",
+      "      - 48",
+      "      - 49",
+      "      - 50",
+      "      - 51",
+      "      - 52",
+      "      - 53",
+      "    - key 53",
+      "    - leaf (size 5)",
+      "      - 54",
+      "      - 55",
+      "      - 56",
+      "      - 58",
+      "      - 59",
+      "    - key 59",
+      "    - leaf (size 6)",
+      "      - 60",
+      "      - 63",
+      "      - 65",
+      "      - 66",
+      "      - 67",
+      "      - 68",
+      "    - key 68",
+      "    - leaf (size 6)",
+      "      - 69",
+      "      - 70",
+      "      - 71",
+      "      - 72",
+      "      - 75",
+      "      - 76",
+      "    - key 76",
+      "    - leaf (size 7)",
+      "      - 77",
+      "      - 78",
+      "      - 79",
+      "      - 81",
+      "      - 82",
+      "      - 85",
+      "      - 86",
+      "db > ",
+    ])
+  end
+
+  it 'deletes a row' do
+    result = run_script([
+      "insert 1 user1 person1@example.com",
+      "insert 2 user2 person2@example.com",
+      "delete 1",
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > {2 user2 person2@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'prints an error message if the deleted key does not exist' do
+    result = run_script([
+      "insert 1 user1 person1@example.com",
+      "delete 2",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Error: Key not found.",
+      "db > ",
+    ])
+  end
+
+  it 'merges leaves and collapses the root after deletes' do
+    script = (1..15).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script += (1..4).map do |i|
+      "delete #{i}"
+    end
+    script << ".btree"
+    script << ".exit"
+    result = run_script(script, "-page-size 512")
+
+    expect(result[21...(result.length)]).to match_array([
+      "db > Tree:",
+      "- leaf (size 11)",
+      "  - 5",
+      "  - 6",
+      "  - 7",
+      "  - 8",
+      "  - 9",
+      "  - 10",
+      "  - 11",
+      "  - 12",
+      "  - 13",
+      "  - 14",
+      "  - 15",
+      "db > ",
+    ])
+  end
+
+  it 'selects a range of keys' do
+    script = (1..100).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script << "select where id >= 40 and id < 43"
+    script << "select where id > 98"
+    script << "select where id = 7"
+    script << "select where id < 1"
+    script << ".exit"
+    result = run_script(script, "-page-size 512")
+
+    expect(result.last(11)).to match_array([
+      "db > {40 user40 person40@example.com}",
+      "{41 user41 person41@example.com}",
+      "{42 user42 person42@example.com}",
+      "Executed.",
+      "db > {99 user99 person99@example.com}",
+      "{100 user100 person100@example.com}",
+      "Executed.",
+      "db > {7 user7 person7@example.com}",
+      "Executed.",
+      "db > Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'selects rows in descending order' do
+    script = (1..100).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script << "select order by id desc limit 3"
+    script << "select where id < 40 order by id desc limit 2"
+    script << ".exit"
+    result = run_script(script, "-page-size 512")
+
+    expect(result.last(8)).to match_array([
+      "db > {100 user100 person100@example.com}",
+      "{99 user99 person99@example.com}",
+      "{98 user98 person98@example.com}",
+      "Executed.",
+      "db > {39 user39 person39@example.com}",
+      "{38 user38 person38@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'updates rows by key or by a column' do
+    result = run_script([
+      "insert 1 user1 person1@example.com",
+      "insert 2 user2 person2@example.com",
+      "insert 3 user2 person3@example.com",
+      "update set email=new@example.com where id=1",
+      "update set username=user3 where username=user2",
+      "update set email=none@example.com where id=4",
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Updated 1 rows.",
+      "Executed.",
+      "db > Updated 2 rows.",
+      "Executed.",
+      "db > Updated 0 rows.",
+      "Executed.",
+      "db > {1 user1 new@example.com}",
+      "{2 user3 person2@example.com}",
+      "{3 user3 person3@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'moves a row whose key is updated' do
+    result = run_script([
+      "insert 1 user1 person1@example.com",
+      "insert 2 user2 person2@example.com",
+      "update set id=2 where id=1",
+      "update set id=3 where id=1",
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Error: Duplicate key.",
+      "db > Updated 1 rows.",
+      "Executed.",
+      "db > {2 user2 person2@example.com}",
+      "{3 user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'reuses space freed inside a leaf' do
+    script = (1..11).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script << "delete 5"
+    script << "insert 12 user12 person12@example.com"
+    script << ".btree"
+    script << ".exit"
+    result = run_script(script, "-page-size 512")
+
+    expect(result[15...(result.length)]).to match_array([
+      "db > Tree:",
+      "- leaf (size 11)",
+      "  - 1",
+      "  - 2",
+      "  - 3",
+      "  - 4",
+      "  - 6",
+      "  - 7",
+      "  - 8",
+      "  - 9",
+      "  - 10",
+      "  - 11",
+      "  - 12",
+      "db > ",
+    ])
+  end
+
+  it 'reuses pages released by deletes' do
+    script = (1..15).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script += (1..4).map do |i|
+      "delete #{i}"
+    end
+    script << ".dbinfo"
+    script += (1..4).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script << ".dbinfo"
+    script << ".exit"
+    result = run_script(script, "-page-size 512")
+
+    expect(result[21...(result.length)]).to match_array([
+      "db > format version: 1",
+      "page size: 512",
+      "page count: 4",
+      "root page: 1",
+      "freelist trunk page: 2",
+      "freelist page count: 2",
+      "schema cookie: 0",
+      "key type: int64",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > format version: 1",
+      "page size: 512",
+      "page count: 4",
+      "root page: 1",
+      "freelist trunk page: 0",
+      "freelist page count: 0",
+      "schema cookie: 0",
+      "key type: int64",
+      "db > ",
+    ])
+  end
+
+  it 'vacuums the database into a smaller file' do
+    script = (1..100).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script += (1..80).map do |i|
+      "delete #{i}"
+    end
+    script << "vacuum"
+    script << ".check"
+    script << ".exit"
+    result = run_script(script, "-page-size 512")
+
+    expect(result.last(4)).to match_array([
+      "db > Reclaimed 10752 bytes.",
+      "Executed.",
+      "db > ok",
+      "db > ",
+    ])
+    expect(File.size("test.db")).to eq(4 * 512)
+
+    result = run_script([
+      "select where id > 98",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > {99 user99 person99@example.com}",
+      "{100 user100 person100@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'rolls back the changes of a crashed session' do
+    run_script([
+      "insert 1 user1 person1@example.com",
+      ".exit",
+    ])
+
+    # Evict pages to the file, then die before committing the transaction
+    IO.popen("./main -cache-size 1 test.db", "r+") do |pipe|
+      pipe.puts "begin"
+      (2..100).each do |i|
+        pipe.puts "insert #{i} user#{i} person#{i}@example.com"
+      end
+      pipe.puts "select"
+      loop do
+        break if pipe.gets.include?("{100 user100")
+      end
+      Process.kill("KILL", pipe.pid)
+    end
+    expect(File.exist?("test.db-journal")).to be true
+
+    result = run_script([
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > {1 user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+    expect(File.exist?("test.db-journal")).to be false
+  end
+
+  it 'refuses a journal with a page size the database cannot have' do
+    run_script([
+      "insert 1 user1 person1@example.com",
+      ".exit",
+    ], "-page-size 4096")
+    size = File.size("test.db")
+
+    [[0, "Unsupported journal page size 0."],
+     [1000000, "Unsupported journal page size 1000000."],
+     [8192, "The journal page size 8192 does not match the database page size 4096."]].each do |page_size, error|
+      File.binwrite("test.db-journal", "GoSQLite journal" + [page_size, 500].pack("VV"))
+      result = run_script([])
+      expect(result).to match_array([error])
+      expect(File.size("test.db")).to eq(size)
+      expect(File.exist?("test.db-journal")).to be true
+    end
+  end
+
+  it 'copies the WAL into the database file on checkpoint' do
+    script = (1..20).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script << ".checkpoint"
+    script << ".checkpoint"
+    script << ".exit"
+    result = run_script(script, "-journal-mode wal -page-size 512")
+
+    expect(result.last(3)).to match_array([
+      "db > Checkpointed 5 pages.",
+      "db > Checkpointed 0 pages.",
+      "db > ",
+    ])
+    expect(File.size("test.db")).to eq(5 * 512)
+    expect(File.exist?("test.db-wal")).to be false
+  end
+
+  it 'discards uncommitted frames of a crashed session in WAL mode' do
+    run_script([
+      "insert 1 user1 person1@example.com",
+      ".exit",
+    ])
+
+    # Evict pages to the WAL, then die before committing the transaction
+    IO.popen("./main -journal-mode wal -cache-size 1 test.db", "r+") do |pipe|
+      pipe.puts "begin"
+      (2..100).each do |i|
+        pipe.puts "insert #{i} user#{i} person#{i}@example.com"
+      end
+      pipe.puts "select"
+      loop do
+        break if pipe.gets.include?("{100 user100")
+      end
+      Process.kill("KILL", pipe.pid)
+    end
+    expect(File.exist?("test.db-wal")).to be true
+
+    result = run_script([
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > {1 user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+    expect(File.exist?("test.db-wal")).to be false
+  end
+
+  it 'rolls back a transaction' do
+    result = run_script([
+      "insert 1 user1 person1@example.com",
+      "begin",
+      "insert 2 user2 person2@example.com",
+      "delete 1",
+      "rollback",
+      "begin",
+      "insert 3 user3 person3@example.com",
+      "commit",
+      "commit",
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Error: No transaction is active.",
+      "db > {1 user1 person1@example.com}",
+      "{3 user3 person3@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'rolls back to a savepoint' do
+    result = run_script([
+      "begin",
+      "insert 1 user1 person1@example.com",
+      "savepoint a",
+      "insert 2 user2 person2@example.com",
+      "savepoint b",
+      "insert 3 user3 person3@example.com",
+      "rollback to a",
+      "release b",
+      "insert 4 user4 person4@example.com",
+      "release a",
+      "commit",
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Error: No such savepoint.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > {1 user1 person1@example.com}",
+      "{4 user4 person4@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'reports a locked database while another process writes' do
+    IO.popen("./main test.db", "r+") do |pipe|
+      pipe.puts "begin"
+      pipe.puts "insert 1 user1 person1@example.com"
+      pipe.puts "select"
+      loop do
+        break if pipe.gets.include?("{1 user1")
+      end
+
+      result = run_script([
+        "insert 2 user2 person2@example.com",
+        "select",
+        ".exit",
+      ])
+      expect(result).to match_array([
+        "Simple SQLite",
+        "---------------------",
+        "db > Error: Database is locked.",
+        "db > Executed.",
+        "db > ",
+      ])
+
+      pipe.puts "commit"
+      pipe.puts ".exit"
+      pipe.read
+    end
+
+    result = run_script([
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > {1 user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'lets readers in while another process writes in WAL mode' do
+    IO.popen("./main -journal-mode wal test.db", "r+") do |pipe|
+      pipe.puts "insert 1 user1 person1@example.com"
+      pipe.puts "begin"
+      pipe.puts "insert 2 user2 person2@example.com"
+      pipe.puts "select"
+      loop do
+        break if pipe.gets.include?("{2 user2")
+      end
+
+      result = run_script([
+        "select",
+        "insert 3 user3 person3@example.com",
+        ".exit",
+      ], "-journal-mode wal")
+      expect(result).to match_array([
+        "Simple SQLite",
+        "---------------------",
+        "db > {1 user1 person1@example.com}",
+        "Executed.",
+        "db > Error: Database is locked.",
+        "db > ",
+      ])
+      expect(run_script([])).to match_array([
+        "Error: Database is open in another journal mode.",
+      ])
+
+      pipe.puts "commit"
+      pipe.puts ".exit"
+      pipe.read
+    end
+    expect(File.exist?("test.db-wal")).to be false
+
+    result = run_script([
+      "select",
+      ".exit",
+    ], "-journal-mode wal")
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > {1 user1 person1@example.com}",
+      "{2 user2 person2@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'refuses to open a file that is not a database' do
+    File.write("test.db", "a" * 4096)
+    result = run_script([])
+    expect(result).to match_array([
+      "File is not a database.",
+    ])
+  end
+
+  it 'refuses to read a corrupted page' do
+    script = (1..30).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script << ".exit"
+    run_script(script)
+    File.open("test.db", "r+b") do |file|
+      file.seek(4096 + 100)
+      file.write("x")
+    end
+
+    result = run_script([
+      "select",
+      "insert 31 user31 person31@example.com",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Error: Checksum mismatch on page 1.",
+      "db > Error: Checksum mismatch on page 1.",
+      "db > ",
+    ])
+  end
+
+  it 'reports every corrupted page' do
+    script = (1..30).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script << ".exit"
+    run_script(script, "-page-size 512")
+    File.open("test.db", "r+b") do |file|
+      file.seek(2 * 512 + 100)
+      file.write("x")
+      file.seek(4 * 512 + 100)
+      file.write("x")
+    end
+
+    result = run_script([
+      ".check",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Page 2: checksum mismatch.",
+      "Page 4: checksum mismatch.",
+      "db > ",
+    ])
+  end
+
+  it 'reports no problems in a valid database' do
+    script = (1..100).map do |i|
+      "insert #{i} user#{i} person#{i}@example.com"
+    end
+    script += (1..100).step(3).map do |i|
+      "delete #{i}"
+    end
+    script << ".check"
+    script << ".exit"
+    result = run_script(script, "-page-size 512")
+
+    expect(result.last(2)).to match_array([
+      "db > ok",
+      "db > ",
+    ])
+  end
+
+  it 'bulk loads sorted rows into full leaves' do
+    File.open("rows.txt", "w") do |file|
+      (1..30).each do |i|
+        file.puts "#{i} user#{i} person#{i}@example.com"
+      end
+    end
+
+    result = run_script([
+      ".load rows.txt 100",
+      ".btree",
+      ".check",
+      ".exit",
+    ], "-page-size 512")
+    File.delete("rows.txt")
+
+    expect(result[2]).to eq("db > Loaded 30 rows.")
+    expect(result).to include("  - leaf (size 11)")
+    expect(result).to include("  - key 11")
+    expect(result).to include("  - key 21")
+    expect(result.last(2)).to match_array([
+      "db > ok",
+      "db > ",
+    ])
+  end
+
+  it 'sorts unsorted rows before bulk loading them' do
+    File.open("rows.txt", "w") do |file|
+      [3, 1, 2].each do |i|
+        file.puts "#{i} user#{i} person#{i}@example.com"
+      end
+    end
+
+    result = run_script([
+      ".load rows.txt",
+      "select",
+      ".exit",
+    ])
+    File.delete("rows.txt")
+
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Loaded 3 rows.",
+      "db > {1 user1 person1@example.com}",
+      "{2 user2 person2@example.com}",
+      "{3 user3 person3@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'rejects a bulk load with duplicate keys' do
+    File.open("rows.txt", "w") do |file|
+      file.puts "3 user3 person3@example.com"
+      file.puts "1 user1 person1@example.com"
+      file.puts "3 user3 person3@example.com"
+    end
+
+    result = run_script([
+      ".load rows.txt",
+      "select",
+      ".exit",
+    ])
+    File.delete("rows.txt")
+
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Error: Duplicate key.",
+      "db > Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'refuses a bulk load into a table that is not empty before reading the file' do
+    File.open("rows.txt", "w") do |file|
+      file.puts "not a row"
+    end
+
+    result = run_script([
+      "insert 1 user1 person1@example.com",
+      ".load rows.txt",
+      ".exit",
+    ])
+    File.delete("rows.txt")
+
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Error: Table is not empty.",
+      "db > ",
+    ])
+  end
+
+  it 'undoes only a failed bulk load inside a transaction' do
+    File.open("rows.txt", "w") do |file|
+      (1..200).each do |i|
+        file.puts "#{i} user#{i} person#{i}@example.com"
+      end
+      file.puts "50 user50 person50@example.com"
+    end
+
+    result = run_script([
+      "begin",
+      ".load rows.txt",
+      "insert 1 user1 person1@example.com",
+      "commit",
+      "select",
+      ".check",
+      ".exit",
+    ], "-page-size 512")
+    File.delete("rows.txt")
+
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Error: Duplicate key.",
+      "db > Executed.",
+      "db > Executed.",
+      "db > {1 user1 person1@example.com}",
+      "Executed.",
+      "db > ok",
+      "db > ",
+    ])
+  end
+
+  it 'keeps the page size chosen at creation' do
+    run_script([
+      "insert 1 user1 person1@example.com",
+      ".exit",
+    ], "-page-size 1024")
+    result = run_script([
+      ".constants",
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Constants:",
+      "PAGE_SIZE: 1024",
+      "PAGE_USABLE_SIZE: 1020",
+      "COMMON_NODE_HEADER_SIZE: 6",
+      "LEAF_NODE_HEADER_SIZE: 22",
+      "LEAF_NODE_CELL_HEADER_SIZE: 6",
+      "LEAF_NODE_SPACE_FOR_CELLS: 998",
+      "LEAF_NODE_MAX_LOCAL_PAYLOAD: 173",
+      "OVERFLOW_PAGE_DATA_SIZE: 1016",
+      "MAX_KEY_SIZE: 64",
+      "INTERNAL_NODE_MAX_CELLS: 14",
+      "db > {1 user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'supports 64-bit ids' do
+    result = run_script([
+      "insert 5000000000 user1 person1@example.com",
+      "insert -3 user2 person2@example.com",
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Executed.",
+      "db > {-3 user2 person2@example.com}",
+      "{5000000000 user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'supports text keys' do
+    long_key = "k"*64
+    result = run_script([
+      "insert bob user1 person1@example.com",
+      "insert alice user2 person2@example.com",
+      "insert #{long_key} user3 person3@example.com",
+      "select",
+      ".exit",
+    ], "-key-type text")
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Executed.",
+      "db > Key is too long.",
+      "db > {alice user2 person2@example.com}",
+      "{bob user1 person1@example.com}",
+      "Executed.",
+      "db > ",
+    ])
+  end
+
+  it 'keeps the composite key type chosen at creation' do
+    run_script([
+      "insert 2,bob user1 person1@example.com",
+      "insert 10,alice user2 person2@example.com",
+      ".exit",
+    ], "-key-type int64,text")
+    result = run_script([
+      "insert 2,alice user3 person3@example.com",
+      "delete 2,bob",
+      "select",
+      ".exit",
+    ])
+    expect(result).to match_array([
+      "Simple SQLite",
+      "---------------------",
+      "db > Executed.",
+      "db > Executed.",
+      "db > {2,alice user3 person3@example.com}",
+      "{10,alice user2 person2@example.com}",
+      "Executed.",
+      "db > ",
+    ])
   end
-end
\ No newline at end of file
+end